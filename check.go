@@ -0,0 +1,24 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/austingebauer/go-tcp-metrics-proxy/proxy"
+	"log"
+)
+
+// check validates the proxy configuration set by the passed flags without running
+// the proxy. Exits non-zero if the configuration is invalid.
+func check(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	registerFlags(fs)
+	_ = fs.Parse(args)
+
+	config := proxy.NewConfig(listenAddress, targetAddress, metricAddress, configOptions()...)
+	err := config.Validate()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println("configuration is valid")
+}
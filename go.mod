@@ -1,6 +1,6 @@
 module github.com/austingebauer/go-tcp-metrics-proxy
 
-go 1.12
+go 1.16
 
 require (
 	github.com/google/uuid v1.1.1
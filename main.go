@@ -1,71 +1,53 @@
 package main
 
 import (
-	"flag"
-	"github.com/austingebauer/go-tcp-metrics-proxy/proxy"
-	"log"
+	"fmt"
 	"os"
-	"os/signal"
-	"syscall"
+	"strings"
 )
 
-var (
-	listenAddress string
-	targetAddress string
-	metricAddress string
-)
-
-func init() {
-	flag.StringVar(&listenAddress, "listen", "127.0.0.1:3000",
-		"IP address and port number that the proxy will listen on")
-	flag.StringVar(&targetAddress, "target", "127.0.0.1:3001",
-		"IP address and port number that the proxy will forward to")
-	flag.StringVar(&metricAddress, "metrics", "127.0.0.1:3002",
-		"IP address and port number to expose prometheus metrics on")
+// command is a subcommand of the proxy executable.
+type command struct {
+	name        string
+	description string
+	run         func(args []string)
 }
 
-func main() {
-	// Parse flags and assign to configuration
-	flag.Parse()
-	config := proxy.NewConfig(listenAddress, targetAddress, metricAddress)
-
-	// Set up channels and signal handling
-	errorCh := make(chan error)
-	doneCh := make(chan struct{})
-	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
-
-	// Configure and run the proxy
-	p := proxy.NewProxy(config, doneCh)
-	go func() {
-		errorCh <- p.Start()
-	}()
-
-	var finalError error
+// defaultCommand is the name of the command run when no command is given.
+const defaultCommand = "serve"
 
-	// Block until an error or signal is received
-	select {
-	case sig := <-signalCh:
-		log.Printf("received signal: %v\n", sig)
+// commands are the subcommands of the proxy executable.
+var commands = []command{
+	{name: "serve", description: "Run the proxy (default)", run: serve},
+	{name: "check", description: "Validate the configuration without running the proxy", run: check},
+	{name: "version", description: "Print the version of the proxy", run: printVersion},
+}
 
-		// Stop gracefully for SIGTERM and SIGINT
-		p.StopGraceful()
-	case err := <-errorCh:
-		finalError = err
+func main() {
+	// Run the default command if the first argument is a flag rather than a command,
+	// so that flags without a command keep working
+	name, args := defaultCommand, os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
 
-		// Stop forcefully for errors
-		p.StopForceful()
+	for _, cmd := range commands {
+		if cmd.name == name {
+			cmd.run(args)
+			return
+		}
 	}
 
-	// Block until the done channel has been closed by the proxy
-	<-doneCh
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
+}
 
-	// If the proxy stopped due to an error, then log fatally
-	if finalError != nil {
-		log.Fatal(finalError)
+// usage prints the commands of the proxy executable.
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s%s\n", cmd.name, cmd.description)
 	}
-
-	// Otherwise, the proxy stopped due to a signal, so exit 0
-	log.Println("exit: 0")
-	os.Exit(0)
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the flags of a command.\n", os.Args[0])
 }
@@ -0,0 +1,11 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"os"
+)
+
+// notifyPause does nothing, since SIGUSR1 is not available on this platform.
+func notifyPause(ch chan<- os.Signal) {}
@@ -0,0 +1,15 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyPause relays SIGUSR1, which toggles pausing the proxy, to the passed channel.
+func notifyPause(ch chan<- os.Signal) {
+	signal.Notify(ch, syscall.SIGUSR1)
+}
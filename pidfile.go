@@ -0,0 +1,30 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// writePIDFile writes the PID of the proxy to the passed path. An existing file is
+// overwritten with a warning, since it is left behind by a proxy that did not shut
+// down cleanly, or belongs to another proxy running with the same PID file.
+func writePIDFile(path string) error {
+	existing, err := ioutil.ReadFile(path)
+	if err == nil {
+		log.Printf("warning: overwriting existing PID file %s containing PID %s: "+
+			"a previous proxy may not have shut down cleanly\n", path, strings.TrimSpace(string(existing)))
+	}
+
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// removePIDFile removes the PID file at the passed path, logging any failure.
+func removePIDFile(path string) {
+	err := os.Remove(path)
+	if err != nil {
+		log.Printf("error removing PID file: %v\n", err)
+	}
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// accessLogCommon is the Common Log Format access log format.
+	accessLogCommon = "common"
+
+	// accessLogCombined is the Combined Log Format access log format, which adds
+	// the referer and user agent of each request to the Common Log Format.
+	accessLogCombined = "combined"
+
+	// accessLogTimeFormat is the format of timestamps in the access log.
+	accessLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
+
+// accessLogEscaper escapes quoted fields of access log lines.
+var accessLogEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// accessLog writes a line to stdout for each observed HTTP request, in Common
+// or Combined Log Format. It is safe for concurrent use.
+type accessLog struct {
+	format string
+	logger *log.Logger
+}
+
+// newAccessLog returns a new access log that writes lines in the passed format.
+func newAccessLog(format string) *accessLog {
+	return &accessLog{
+		format: format,
+		logger: log.New(os.Stdout, "", 0),
+	}
+}
+
+// log writes the access log line of the passed request, received from the passed
+// client at the passed time, whose response had the passed status and body size.
+func (a *accessLog) log(client string, received time.Time, req *http.Request, status int, bytes int64) {
+	size := "-"
+	if bytes > 0 {
+		size = fmt.Sprint(bytes)
+	}
+	line := fmt.Sprintf(`%s - - [%s] "%s %s %s" %d %s`,
+		client,
+		received.Format(accessLogTimeFormat),
+		accessLogEscaper.Replace(req.Method),
+		accessLogEscaper.Replace(req.RequestURI),
+		accessLogEscaper.Replace(req.Proto),
+		status,
+		size)
+	if a.format == accessLogCombined {
+		line += fmt.Sprintf(` "%s" "%s"`, quotedField(req.Referer()), quotedField(req.UserAgent()))
+	}
+
+	a.logger.Println(line)
+}
+
+// quotedField returns the passed value escaped for a quoted access log field,
+// or a dash if it is empty.
+func quotedField(value string) string {
+	if value == "" {
+		return "-"
+	}
+
+	return accessLogEscaper.Replace(value)
+}
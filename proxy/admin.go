@@ -0,0 +1,299 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// redacted replaces secret configuration values served by the config endpoint.
+	redacted = "REDACTED"
+)
+
+// stats is a snapshot of the state of the proxy served by the stats endpoint.
+type stats struct {
+	ActiveInboundConnections     int64           `json:"active_inbound_connections"`
+	ActiveOutboundConnections    int64           `json:"active_outbound_connections"`
+	MaxActiveInboundConnections  int64           `json:"max_active_inbound_connections"`
+	MaxActiveOutboundConnections int64           `json:"max_active_outbound_connections"`
+	Targets                      map[string]bool `json:"targets"`
+	DrainingTargets              []string        `json:"draining_targets"`
+	Draining                     bool            `json:"draining"`
+	Paused                       bool            `json:"paused"`
+}
+
+// adminHandler returns the handler of the admin server, which routes requests to
+// the metrics and admin endpoints by path. The health and readiness endpoints
+// are not authenticated so that they can be used by load balancer health checks.
+func (p *proxy) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", p.authHandler(promhttp.Handler()))
+	mux.HandleFunc("/healthz", p.handleHealthz)
+	mux.HandleFunc("/ready", p.handleReady)
+	mux.Handle("/stats", p.authHandler(http.HandlerFunc(p.handleStats)))
+	mux.Handle("/config", p.authHandler(http.HandlerFunc(p.handleConfig)))
+	mux.Handle("/drain", p.authHandler(http.HandlerFunc(p.handleDrain)))
+	mux.Handle("/drain-target", p.authHandler(http.HandlerFunc(p.handleDrainTarget)))
+	mux.Handle("/pause", p.authHandler(http.HandlerFunc(p.handlePause)))
+	mux.Handle("/resume", p.authHandler(http.HandlerFunc(p.handleResume)))
+	return mux
+}
+
+// handleHealthz responds with 200 OK for as long as the proxy is running.
+func (p *proxy) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// handleReady responds with 200 OK if the proxy is accepting new connections,
+// or 503 Service Unavailable if it is still starting, draining, or paused.
+func (p *proxy) handleReady(w http.ResponseWriter, r *http.Request) {
+	if !p.isReady() {
+		http.Error(w, "starting", http.StatusServiceUnavailable)
+		return
+	}
+	if p.isDraining() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	if p.IsPaused() {
+		http.Error(w, "paused", http.StatusServiceUnavailable)
+		return
+	}
+
+	_, _ = w.Write([]byte("ready\n"))
+}
+
+// handleStats responds with a JSON snapshot of the connections and targets of the proxy.
+func (p *proxy) handleStats(w http.ResponseWriter, r *http.Request) {
+	maxActiveConnMu.Lock()
+	maxInbound, maxOutbound := maxActiveInboundConnCount, maxActiveOutboundConnCount
+	maxActiveConnMu.Unlock()
+
+	writeJSON(w, stats{
+		ActiveInboundConnections:     atomic.LoadInt64(&activeInboundConnCount),
+		ActiveOutboundConnections:    atomic.LoadInt64(&activeOutboundConnCount),
+		MaxActiveInboundConnections:  maxInbound,
+		MaxActiveOutboundConnections: maxOutbound,
+		Targets:                      p.targets.health(),
+		DrainingTargets:              p.targets.drainingTargets(),
+		Draining:                     p.isDraining(),
+		Paused:                       p.IsPaused(),
+	})
+}
+
+// handleConfig responds with the configuration of the proxy as JSON, keyed by flag name.
+// Secret values are redacted.
+func (p *proxy) handleConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, p.configValues())
+}
+
+// configValues returns the configuration of the proxy keyed by flag name,
+// with secret values redacted.
+func (p *proxy) configValues() map[string]interface{} {
+	c := p.config
+
+	metricsAuth := ""
+	if c.metricsUsername != "" {
+		metricsAuth = c.metricsUsername + ":" + redacted
+	}
+	metricsBearerToken := ""
+	if c.metricsBearerToken != "" {
+		metricsBearerToken = redacted
+	}
+	labels := c.labels
+	if labels == nil {
+		labels = []string{}
+	}
+
+	return map[string]interface{}{
+		"name":                    c.name,
+		"listen":                  c.listenAddress,
+		"announce-file":           c.announceFile,
+		"listen-netns":            c.listenNetns,
+		"accept-workers":          c.acceptWorkers,
+		"fault-drop-rate":         c.faultDropRate,
+		"fault-delay":             c.faultDelay.String(),
+		"fault-seed":              c.faultSeed,
+		"asymmetry-threshold":     c.asymmetryThreshold,
+		"global-rate-limit":       c.globalRateLimit,
+		"max-accept-rate":         c.maxAcceptRate,
+		"tarpit":                  c.tarpit.String(),
+		"max-tarpit":              c.maxTarpit,
+		"reject-response-file":    c.rejectResponseFile,
+		"backend-prelude-file":    c.backendPreludeFile,
+		"client-prelude-file":     c.clientPreludeFile,
+		"mode":                    c.mode,
+		"target":                  c.targetAddress,
+		"targets-file":            c.targetsFile,
+		"dial-timeout":            c.dialTimeout.String(),
+		"fallback-target":         c.fallbackTarget,
+		"reload-drain":            c.reloadDrain.String(),
+		"unhealthy-drain":         c.unhealthyDrain.String(),
+		"target-netns":            c.targetNetns,
+		"target-ip-family":        c.targetIPFamily,
+		"transparent-dest":        c.transparentDest,
+		"bind-address":            c.bindAddress,
+		"ttl":                     c.ttl,
+		"immediate-close-window":  c.immediateCloseWindow.String(),
+		"immediate-close-retry":   c.immediateCloseRetry,
+		"per-conn-probe":          c.probe,
+		"per-conn-probe-response": c.probeResponse,
+		"per-conn-probe-timeout":  c.probeTimeout.String(),
+		"lazy-dial":               c.lazyDial,
+		"first-byte-timeout":      c.firstByteTimeout.String(),
+		"tcp-fastopen":            c.tcpFastOpen,
+		"user-timeout":            c.userTimeout.String(),
+		"linger":                  c.linger,
+		"dns-server":              c.dnsServer,
+		"no-healthy-targets":      c.noHealthyTargets,
+		"loop-detection":          c.loopDetection,
+		"inline-copy":             c.inlineCopy,
+		"stall-buffer-size":       c.stallBufferSize,
+		"forceful-reset":          c.forcefulReset,
+		"termination-grace":       c.terminationGrace.String(),
+		"drain-log-interval":      c.drainLogInterval.String(),
+		"drain-idle-timeout":      c.drainIdleTimeout.String(),
+		"close-both-on-error":     c.closeBothOnError,
+		"write-timeout":           c.writeTimeout.String(),
+		"max-half-open":           c.maxHalfOpen,
+		"max-session-duration":    c.maxSessionDuration.String(),
+		"min-rate":                c.minRate,
+		"min-rate-grace":          c.minRateGrace.String(),
+		"max-subnet-labels":       c.maxSubnetLabels,
+		"metrics":                 c.metricsAddress,
+		"metrics-allow-external":  c.metricsAllowExternal,
+		"metrics-auth":            metricsAuth,
+		"metrics-bearer-token":    metricsBearerToken,
+		"metrics-tls-cert":        c.metricsTLSCert,
+		"metrics-tls-key":         c.metricsTLSKey,
+		"label":                   labels,
+		"http-metrics":            c.httpMetrics,
+		"statsd-addr":             c.statsdAddress,
+		"established-after":       c.establishedAfter.String(),
+		"audit-log":               c.auditLog,
+		"access-log":              c.accessLog,
+		"log-level":               c.logLevelName,
+		"log-rate":                c.logRate,
+		"log-config":              c.logConfig,
+		"log-sample-rate":         c.logSampleRate,
+		"x-forwarded-for":         c.forwardedFor,
+		"max-header-bytes":        c.maxHeaderBytes,
+	}
+}
+
+// logConfig logs the configuration of the proxy on a single line of flag=value
+// pairs sorted by flag name, with secret values redacted.
+func (p *proxy) logConfig() {
+	values := p.configValues()
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		value := values[name]
+		if labels, ok := value.([]string); ok {
+			value = strings.Join(labels, ",")
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%v", name, value))
+	}
+	p.logger.infof("effective configuration: %s", strings.Join(pairs, " "))
+}
+
+// handleDrain starts draining the proxy. New connections are refused and the
+// readiness endpoint fails, while existing connections are proxied until they end.
+func (p *proxy) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if p.startDraining() {
+		p.logger.infof("draining: refusing new connections")
+	}
+	_, _ = w.Write([]byte("draining\n"))
+}
+
+// handlePause pauses the proxy. New connections are closed immediately
+// while existing connections continue, until the proxy is resumed.
+func (p *proxy) handlePause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	p.Pause()
+	_, _ = w.Write([]byte("paused\n"))
+}
+
+// handleResume resumes accepting new connections after the proxy was paused.
+func (p *proxy) handleResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	p.Resume()
+	_, _ = w.Write([]byte("resumed\n"))
+}
+
+// Pause pauses the proxy. New connections are closed immediately while
+// existing connections continue, until the proxy is resumed.
+func (p *proxy) Pause() {
+	if atomic.CompareAndSwapInt32(&p.paused, 0, 1) {
+		pausedGauge.WithLabelValues(id).Set(1)
+		p.logger.infof("paused: closing new connections")
+	}
+}
+
+// Resume resumes accepting new connections after the proxy was paused.
+func (p *proxy) Resume() {
+	if atomic.CompareAndSwapInt32(&p.paused, 1, 0) {
+		pausedGauge.WithLabelValues(id).Set(0)
+		p.logger.infof("resumed: accepting new connections")
+	}
+}
+
+// IsPaused returns true if the proxy is paused.
+func (p *proxy) IsPaused() bool {
+	return atomic.LoadInt32(&p.paused) == 1
+}
+
+// startDraining marks the proxy as draining.
+// Returns false if the proxy was already draining.
+func (p *proxy) startDraining() bool {
+	return atomic.CompareAndSwapInt32(&p.draining, 0, 1)
+}
+
+// isReady returns true once the proxy is fully set up and handling connections.
+func (p *proxy) isReady() bool {
+	select {
+	case <-p.readyCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// isDraining returns true if the proxy is draining.
+func (p *proxy) isDraining() bool {
+	return atomic.LoadInt32(&p.draining) == 1
+}
+
+// writeJSON writes the passed value to the passed response writer as JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
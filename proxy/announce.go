@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// writeAnnounceFile writes the address that the TCP listener is bound to to the
+// configured announce file. The address is written to a temporary file that is
+// renamed into place, so that processes polling for the file never read a
+// partially written address.
+func (p *proxy) writeAnnounceFile() error {
+	path := p.config.announceFile
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(p.tcpListener.Addr().String() + "\n")
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// removeAnnounceFile removes the configured announce file, if any, so that a stopped
+// proxy is not found by its address. A file that was never written is ignored.
+func (p *proxy) removeAnnounceFile() {
+	if p.config.announceFile == "" {
+		return
+	}
+
+	err := os.Remove(p.config.announceFile)
+	if err != nil && !os.IsNotExist(err) {
+		p.logger.errorf("error occurred removing announce file: %v", err)
+	}
+}
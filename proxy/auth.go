@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+const (
+	// bearerPrefix is the prefix of the Authorization header value of bearer token credentials.
+	bearerPrefix = "Bearer "
+
+	// authRealm is the realm of the basic auth challenge returned to unauthenticated requests.
+	authRealm = "go-tcp-metrics-proxy"
+)
+
+// authHandler returns a handler that serves requests with the passed handler only if
+// they carry the configured basic auth or bearer token credentials. Requests without
+// valid credentials are answered with 401 Unauthorized. If no credentials are
+// configured, the passed handler is returned unchanged.
+func (p *proxy) authHandler(next http.Handler) http.Handler {
+	if p.config.metricsUsername == "" && p.config.metricsBearerToken == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !p.authorized(r) {
+			if p.config.metricsUsername != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="`+authRealm+`"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="`+authRealm+`"`)
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorized returns true if the passed request carries the configured credentials.
+// Credentials are compared in constant time to avoid leaking them through timing.
+func (p *proxy) authorized(r *http.Request) bool {
+	if p.config.metricsUsername != "" {
+		username, password, ok := r.BasicAuth()
+		return ok && secureEqual(username, p.config.metricsUsername) &&
+			secureEqual(password, p.config.metricsPassword)
+	}
+
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, bearerPrefix) {
+		return false
+	}
+	return secureEqual(strings.TrimPrefix(header, bearerPrefix), p.config.metricsBearerToken)
+}
+
+// secureEqual returns true if the passed strings are equal, in constant time.
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
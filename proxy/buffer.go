@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"io"
+)
+
+const (
+	// copyChunkSize is the maximum number of bytes read at once by the buffered copy.
+	copyChunkSize = 32 * 1024
+)
+
+// bufferedCopy copies bytes from the passed reader to the passed writer until either
+// EOF is reached on the reader or an error occurs. Bytes are read ahead of the writer
+// into a bounded in-memory buffer of the configured stall buffer size, so that short
+// stalls writing to the writer do not stall reading from the reader. Once the buffer
+// is full, reading blocks until the writer catches up.
+// Returns the number of bytes written and the first error encountered.
+func (p *proxy) bufferedCopy(writer io.Writer, reader io.Reader) (int64, error) {
+	chunkSize := copyChunkSize
+	if p.config.stallBufferSize < chunkSize {
+		chunkSize = p.config.stallBufferSize
+	}
+	chunkCount := (p.config.stallBufferSize + chunkSize - 1) / chunkSize
+
+	// Buffers cycle from free, to being read into, to chunks, to being written, and back to free
+	free := make(chan []byte, chunkCount+1)
+	chunks := make(chan []byte, chunkCount+1)
+	for i := 0; i < chunkCount+1; i++ {
+		free <- make([]byte, chunkSize)
+	}
+	bufferSize := float64((chunkCount + 1) * chunkSize)
+	bufferMemoryGauge.WithLabelValues(id).Add(bufferSize)
+	defer bufferMemoryGauge.WithLabelValues(id).Sub(bufferSize)
+
+	// Write chunks in their own goroutine until chunks is closed
+	writeDoneCh := make(chan struct{})
+	writeErrCh := make(chan error, 1)
+	var written int64
+	go func() {
+		var err error
+		for chunk := range chunks {
+			if err == nil {
+				var n int
+				n, err = writer.Write(chunk)
+				written += int64(n)
+				if err != nil {
+					close(writeDoneCh)
+				}
+			}
+			free <- chunk[:cap(chunk)]
+		}
+		writeErrCh <- err
+	}()
+
+	var readErr error
+read:
+	for {
+		// Stop reading once the writer has failed, since no more bytes can be written
+		select {
+		case <-writeDoneCh:
+			break read
+		default:
+		}
+
+		// Take a free buffer, applying backpressure if the writer has fallen behind
+		var buf []byte
+		select {
+		case buf = <-free:
+		default:
+			copyBufferFullCounter.WithLabelValues(id).Inc()
+			select {
+			case buf = <-free:
+			case <-writeDoneCh:
+			}
+		}
+		if buf == nil {
+			break
+		}
+
+		n, err := reader.Read(buf)
+		if n > 0 {
+			chunks <- buf[:n]
+		} else {
+			free <- buf
+		}
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
+			}
+			break
+		}
+	}
+
+	close(chunks)
+	writeErr := <-writeErrCh
+	if writeErr != nil {
+		return written, writeErr
+	}
+
+	return written, readErr
+}
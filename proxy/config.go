@@ -1,31 +1,718 @@
 package proxy
 
 import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"math"
 	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// nameLabel is the name of the constant label holding the name of the proxy.
+	nameLabel = "name"
+)
+
+var (
+	labelNameRegexp = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+	// reservedLabels are the names of the variable labels of the proxy's metrics, and of
+	// the bucket label of its histograms, which constant labels must not duplicate.
+	reservedLabels = map[string]struct{}{
+		"id":        {},
+		"target":    {},
+		"reason":    {},
+		"mode":      {},
+		"subnet":    {},
+		"method":    {},
+		"status":    {},
+		"direction": {},
+		"fault":     {},
+		"le":        {},
+	}
 )
 
 // config is the configuration required to run a proxy
 type config struct {
-	listenAddress  string
-	listenHost     string
-	listenPort     string
-	targetAddress  string
-	targetHost     string
-	targetPort     string
-	metricsAddress string
-	metricsHost    string
-	metricsPort    string
+	listenAddress        string
+	listenHost           string
+	listenPort           string
+	targetAddress        string
+	targetHost           string
+	targetPort           string
+	metricsAddress       string
+	metricsHost          string
+	metricsPort          string
+	logLevelName         string
+	logLevel             logLevel
+	logSampleRate        int
+	forwardedFor         bool
+	targetsFile          string
+	dialTimeout          time.Duration
+	noHealthyTargets     string
+	maxSessionDuration   time.Duration
+	maxSubnetLabels      int
+	bindAddress          string
+	bindIP               net.IP
+	targetIPFamily       string
+	targetNetwork        string
+	writeTimeout         time.Duration
+	drainIdleTimeout     time.Duration
+	logConfig            bool
+	closeBothOnError     bool
+	forcefulReset        bool
+	logRate              int
+	statsdAddress        string
+	labels               []string
+	constLabels          prometheus.Labels
+	httpMetrics          bool
+	loopDetection        bool
+	stallBufferSize      int
+	dnsServer            string
+	metricsAuth          string
+	metricsUsername      string
+	metricsPassword      string
+	metricsBearerToken   string
+	metricsTLSCert       string
+	metricsTLSKey        string
+	drainLogInterval     time.Duration
+	maxHeaderBytes       int
+	minRate              int
+	minRateGrace         time.Duration
+	ttl                  int
+	immediateCloseWindow time.Duration
+	immediateCloseRetry  bool
+	reloadDrain          time.Duration
+	tcpFastOpen          bool
+	linger               int
+	acceptWorkers        int
+	fallbackTarget       string
+	mode                 string
+	unhealthyDrain       time.Duration
+	maxAcceptRate        float64
+	tarpit               time.Duration
+	maxTarpit            int
+	lazyDial             bool
+	firstByteTimeout     time.Duration
+	listenNetns          string
+	targetNetns          string
+	accessLog            string
+	filters              []ConnectionFilter
+	transformers         []StreamTransformer
+	targetResolver       TargetResolver
+	transparentDest      bool
+	faultDropRate        float64
+	faultDelay           time.Duration
+	faultSeed            int64
+	globalRateLimit      int
+	announceFile         string
+	asymmetryThreshold   float64
+	probe                string
+	probeResponse        string
+	probeTimeout         time.Duration
+	metricsAllowExternal bool
+	name                 string
+	terminationGrace     time.Duration
+	inlineCopy           bool
+	maxHalfOpen          int
+	auditLog             string
+	establishedAfter     time.Duration
+	userTimeout          time.Duration
+	rejectResponseFile   string
+	backendPreludeFile   string
+	clientPreludeFile    string
+}
+
+// Option is a function that sets an optional value on a config.
+type Option func(c *config)
+
+// WithLogLevel sets the minimum level of messages logged by the proxy.
+// Must be one of debug, info, warn, or error.
+func WithLogLevel(level string) Option {
+	return func(c *config) {
+		c.logLevelName = level
+	}
+}
+
+// WithLogSampleRate sets the proxy to log 1 in every rate connections
+// started and ended. Errors and rejections are never sampled out.
+func WithLogSampleRate(rate int) Option {
+	return func(c *config) {
+		c.logSampleRate = rate
+	}
+}
+
+// WithForwardedFor sets whether the proxy sets the X-Forwarded-For header
+// on the first request of connections carrying plaintext HTTP traffic.
+func WithForwardedFor(enabled bool) Option {
+	return func(c *config) {
+		c.forwardedFor = enabled
+	}
+}
+
+// WithTargetsFile sets the path of a file containing the target addresses
+// that connections are forwarded to, one per line. The file is watched for
+// changes and takes precedence over the target address.
+func WithTargetsFile(path string) Option {
+	return func(c *config) {
+		c.targetsFile = path
+	}
+}
+
+// WithDialTimeout sets the maximum duration of dialing a target. Targets in the
+// targets file may override it with their own timeout.
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		c.dialTimeout = timeout
+	}
+}
+
+// WithNoHealthyTargets sets the behavior of the proxy when no targets are healthy.
+// Must be one of reject, which rejects new connections, or try-all, which tries
+// unhealthy targets anyway.
+func WithNoHealthyTargets(behavior string) Option {
+	return func(c *config) {
+		c.noHealthyTargets = behavior
+	}
+}
+
+// WithMaxSessionDuration sets the maximum total duration of a proxied connection,
+// regardless of activity. Both sides of a connection are closed once it is exceeded.
+// A duration of zero means connections have no maximum duration.
+func WithMaxSessionDuration(d time.Duration) Option {
+	return func(c *config) {
+		c.maxSessionDuration = d
+	}
+}
+
+// WithMaxSubnetLabels sets the maximum number of distinct client subnets labeled
+// in the connections by subnet metric. Connections from additional subnets are
+// labeled as other.
+func WithMaxSubnetLabels(max int) Option {
+	return func(c *config) {
+		c.maxSubnetLabels = max
+	}
+}
+
+// WithReloadDrain sets the window that connections to targets removed from the
+// targets file are given to finish before they are closed. Zero leaves them open.
+func WithReloadDrain(window time.Duration) Option {
+	return func(c *config) {
+		c.reloadDrain = window
+	}
+}
+
+// WithUnhealthyDrain sets the grace period that connections to a target that became
+// unhealthy are given to finish before they are closed, if the target is still
+// unhealthy by then. Zero leaves them open.
+func WithUnhealthyDrain(grace time.Duration) Option {
+	return func(c *config) {
+		c.unhealthyDrain = grace
+	}
+}
+
+// WithNetns sets the paths of the network namespaces that the listener and outbound
+// connections are created in, e.g. /var/run/netns/<name>. An empty path uses the
+// namespace of the proxy. Network namespaces are only supported on Linux.
+func WithNetns(listenNetns, targetNetns string) Option {
+	return func(c *config) {
+		c.listenNetns = listenNetns
+		c.targetNetns = targetNetns
+	}
 }
 
-// NewConfig returns a new
-func NewConfig(listenAddress, targetAddress, metricsAddress string) config {
-	return config{
-		listenAddress:  listenAddress,
-		targetAddress:  targetAddress,
-		metricsAddress: metricsAddress,
+// WithBindAddress sets the local IP address that outbound connections are made from.
+// The address must be assigned to a local interface.
+func WithBindAddress(address string) Option {
+	return func(c *config) {
+		c.bindAddress = address
 	}
 }
 
+// WithTTL sets the IP TTL (IPv4) or hop limit (IPv6) of outbound packets.
+// Zero leaves the system default in place.
+func WithTTL(ttl int) Option {
+	return func(c *config) {
+		c.ttl = ttl
+	}
+}
+
+// WithImmediateClose sets the window after dialing in which a target closing the
+// connection before sending any bytes is considered broken, and whether the dial is
+// then retried with the next target. A zero window disables detection.
+func WithImmediateClose(window time.Duration, retry bool) Option {
+	return func(c *config) {
+		c.immediateCloseWindow = window
+		c.immediateCloseRetry = retry
+	}
+}
+
+// WithPerConnProbe sets the probe sent to the target of each outbound connection before
+// it is proxied, the response the target must reply with, and the timeout to reply
+// within. Targets that fail the probe are retried with the next target. An empty
+// probe disables probing.
+func WithPerConnProbe(probe, response string, timeout time.Duration) Option {
+	return func(c *config) {
+		c.probe = probe
+		c.probeResponse = response
+		c.probeTimeout = timeout
+	}
+}
+
+// WithLazyDial sets whether the target is dialed only once the client sends its first
+// byte, rather than as soon as the connection is accepted.
+func WithLazyDial(enabled bool) Option {
+	return func(c *config) {
+		c.lazyDial = enabled
+	}
+}
+
+// WithFirstByteTimeout sets the maximum duration that the proxy waits for the first
+// byte from the client when dialing lazily. A timeout of zero means the dial timeout.
+func WithFirstByteTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		c.firstByteTimeout = timeout
+	}
+}
+
+// WithTCPFastOpen sets whether TCP Fast Open is enabled on the listener
+// and outbound connections, where supported.
+func WithTCPFastOpen(enabled bool) Option {
+	return func(c *config) {
+		c.tcpFastOpen = enabled
+	}
+}
+
+// WithMode sets whether the proxy forwards connections to the targets, or acts as
+// the backend itself by echoing or discarding their bytes.
+// Must be one of proxy, echo, or discard.
+func WithMode(mode string) Option {
+	return func(c *config) {
+		c.mode = mode
+	}
+}
+
+// WithFallbackTarget sets the address of a standby target that is dialed when
+// dialing the targets fails or no targets are healthy.
+func WithFallbackTarget(address string) Option {
+	return func(c *config) {
+		c.fallbackTarget = address
+	}
+}
+
+// WithFaults sets the faults injected into proxied connections for chaos testing.
+// Each connection is dropped mid-stream with the passed probability, and each
+// read in both directions is delayed by the passed delay. The random number
+// generator is seeded with the passed seed, or with the current time if zero.
+func WithFaults(dropRate float64, delay time.Duration, seed int64) Option {
+	return func(c *config) {
+		c.faultDropRate = dropRate
+		c.faultDelay = delay
+		c.faultSeed = seed
+	}
+}
+
+// WithAsymmetryThreshold sets the ratio between the bytes copied in each direction of
+// a connection above which the connection is logged and counted as asymmetric when
+// it ends. Zero disables the check.
+func WithAsymmetryThreshold(threshold float64) Option {
+	return func(c *config) {
+		c.asymmetryThreshold = threshold
+	}
+}
+
+// WithAnnounceFile sets the file that the address the proxy listens on is written
+// to once it is listening, and removed from on shutdown. Combined with port 0 in
+// the listen address, this lets other processes find a dynamically chosen port.
+func WithAnnounceFile(path string) Option {
+	return func(c *config) {
+		c.announceFile = path
+	}
+}
+
+// WithGlobalRateLimit sets the maximum aggregate throughput in bytes per second
+// of all connections, shared between them. Zero sets no maximum.
+func WithGlobalRateLimit(rate int) Option {
+	return func(c *config) {
+		c.globalRateLimit = rate
+	}
+}
+
+// WithMaxAcceptRate sets the maximum rate of new connections accepted per second,
+// with bursts of up to one second of connections. Connections in excess of the rate
+// are closed. Zero sets no maximum.
+func WithMaxAcceptRate(rate float64) Option {
+	return func(c *config) {
+		c.maxAcceptRate = rate
+	}
+}
+
+// WithTarpit sets the duration for which connections rejected in excess of the maximum
+// accept rate or by a connection filter are held open, reading and discarding their
+// bytes, before being closed, and the maximum number of connections held open at once.
+// Connections rejected while the maximum is reached are closed immediately. Zero closes
+// rejected connections immediately.
+func WithTarpit(duration time.Duration, max int) Option {
+	return func(c *config) {
+		c.tarpit = duration
+		c.maxTarpit = max
+	}
+}
+
+// WithAcceptWorkers sets the number of goroutines that concurrently accept
+// connections on the listener. Must be at least 1.
+func WithAcceptWorkers(workers int) Option {
+	return func(c *config) {
+		c.acceptWorkers = workers
+	}
+}
+
+// WithLinger sets the SO_LINGER behavior of proxied connections on close, in seconds.
+// A negative value keeps the system default, zero discards unsent bytes and resets
+// the connection, and a positive value blocks close for up to that many seconds
+// while unsent bytes are flushed.
+func WithLinger(seconds int) Option {
+	return func(c *config) {
+		c.linger = seconds
+	}
+}
+
+// WithDNSServer sets the address of the DNS server that target names are resolved with,
+// in place of the resolvers configured for the host.
+func WithDNSServer(address string) Option {
+	return func(c *config) {
+		c.dnsServer = address
+	}
+}
+
+// WithMetricsAllowExternal sets whether the metrics server may listen on an address
+// that is reachable from other hosts without a warning being logged.
+func WithMetricsAllowExternal(allow bool) Option {
+	return func(c *config) {
+		c.metricsAllowExternal = allow
+	}
+}
+
+// WithMetricsAuth sets the basic auth credentials required by the metrics server.
+// Must be in user:pass form.
+func WithMetricsAuth(credentials string) Option {
+	return func(c *config) {
+		c.metricsAuth = credentials
+	}
+}
+
+// WithMetricsBearerToken sets the bearer token required by the metrics server.
+func WithMetricsBearerToken(token string) Option {
+	return func(c *config) {
+		c.metricsBearerToken = token
+	}
+}
+
+// WithMetricsTLS sets the PEM encoded certificate and key files that
+// the metrics server is served over HTTPS with.
+func WithMetricsTLS(certFile, keyFile string) Option {
+	return func(c *config) {
+		c.metricsTLSCert = certFile
+		c.metricsTLSKey = keyFile
+	}
+}
+
+// WithStatsdAddress sets the address of a StatsD agent that metrics are emitted to.
+func WithStatsdAddress(address string) Option {
+	return func(c *config) {
+		c.statsdAddress = address
+	}
+}
+
+// WithConnectionFilters registers filters that are called in order before each
+// accepted connection is handled. Connections rejected by a filter are closed
+// without being proxied. May be passed more than once to register more filters.
+func WithConnectionFilters(filters ...ConnectionFilter) Option {
+	return func(c *config) {
+		c.filters = append(c.filters, filters...)
+	}
+}
+
+// WithStreamTransformers registers transformers that rewrite the bytes copied in both
+// directions, applied in order. May be passed more than once to register more transformers.
+func WithStreamTransformers(transformers ...StreamTransformer) Option {
+	return func(c *config) {
+		c.transformers = append(c.transformers, transformers...)
+	}
+}
+
+// WithForcefulReset sets whether connections are reset when the proxy is stopped
+// forcefully, so that clients receive an RST and fail fast rather than seeing the
+// connection half-closed by a FIN.
+func WithForcefulReset(enabled bool) Option {
+	return func(c *config) {
+		c.forcefulReset = enabled
+	}
+}
+
+// WithCloseBothOnError sets whether both directions of a proxied connection are closed
+// as soon as copying in either direction fails, rather than copying in the other
+// direction until it ends on its own.
+func WithCloseBothOnError(enabled bool) Option {
+	return func(c *config) {
+		c.closeBothOnError = enabled
+	}
+}
+
+// WithLogRate sets the maximum number of lines logged per second. Lines in excess
+// of it are suppressed, and their number is logged periodically. Zero sets no maximum.
+func WithLogRate(rate int) Option {
+	return func(c *config) {
+		c.logRate = rate
+	}
+}
+
+// WithLogConfig sets whether the effective configuration is logged on startup,
+// with secret values redacted.
+func WithLogConfig(enabled bool) Option {
+	return func(c *config) {
+		c.logConfig = enabled
+	}
+}
+
+// WithWriteTimeout sets the maximum duration of each write to either side of a proxied
+// connection. Connections whose peer stops reading, so that a write stalls for longer,
+// are closed. Zero lets writes block indefinitely.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		c.writeTimeout = timeout
+	}
+}
+
+// WithTargetIPFamily sets the IP family that targets are dialed over when their names
+// resolve to both IPv4 and IPv6 addresses: ipv4, ipv6, or auto to let the dialer choose.
+func WithTargetIPFamily(family string) Option {
+	return func(c *config) {
+		c.targetIPFamily = family
+	}
+}
+
+// WithTargetResolver sets a resolver that is called before each connection is dialed
+// to return the address of its target, in place of the configured targets.
+func WithTargetResolver(resolver TargetResolver) Option {
+	return func(c *config) {
+		c.targetResolver = resolver
+	}
+}
+
+// WithTransparentDest sets whether connections are forwarded to the destination they were
+// sent to before an iptables REDIRECT or DNAT rule redirected them to the proxy, as read
+// from SO_ORIGINAL_DST, in place of the configured targets. Only supported on Linux.
+func WithTransparentDest(enabled bool) Option {
+	return func(c *config) {
+		c.transparentDest = enabled
+	}
+}
+
+// WithAuditLog sets the file that a JSON record of each completed connection is
+// appended to, one per line. Empty disables the audit log.
+func WithAuditLog(path string) Option {
+	return func(c *config) {
+		c.auditLog = path
+	}
+}
+
+// WithAccessLog sets the format of the access log of plaintext HTTP requests written
+// to stdout. Must be one of common or combined, or empty to disable the access log.
+func WithAccessLog(format string) Option {
+	return func(c *config) {
+		c.accessLog = format
+	}
+}
+
+// WithName sets the human-readable name of the proxy, which tags its logs and is
+// added to all prometheus metrics as the name label. Unlike the generated id, the
+// name identifies the service being proxied to operators. Empty sets no name.
+func WithName(name string) Option {
+	return func(c *config) {
+		c.name = name
+	}
+}
+
+// WithLabels sets constant labels added to all prometheus metrics of the proxy.
+// Each label must be in key=value form.
+func WithLabels(labels []string) Option {
+	return func(c *config) {
+		c.labels = labels
+	}
+}
+
+// WithHTTPMetrics sets whether the proxy parses plaintext HTTP traffic
+// in order to count requests by method and status.
+func WithHTTPMetrics(enabled bool) Option {
+	return func(c *config) {
+		c.httpMetrics = enabled
+	}
+}
+
+// WithLoopDetection sets whether the proxy closes connections whose
+// target connects back to the proxy itself.
+func WithLoopDetection(enabled bool) Option {
+	return func(c *config) {
+		c.loopDetection = enabled
+	}
+}
+
+// WithMaxHalfOpen sets the maximum number of half-open connections, which have finished
+// sending in one direction while still sending in the other. Connections that become
+// half-open beyond the maximum are closed. Zero sets no maximum.
+func WithMaxHalfOpen(max int) Option {
+	return func(c *config) {
+		c.maxHalfOpen = max
+	}
+}
+
+// WithRejectResponseFile sets the file holding a response, such as an HTTP 503 response,
+// that is written to inbound connections before they are closed when rejected.
+// The response is written as is, so it must suit the protocol of the clients.
+func WithRejectResponseFile(path string) Option {
+	return func(c *config) {
+		c.rejectResponseFile = path
+	}
+}
+
+// WithPreludeFiles sets the files holding preludes, such as protocol greetings, that are
+// written to each target and client as soon as the target is dialed, before any bytes are
+// copied between them. Each prelude is written as is. Empty writes no prelude to that side.
+func WithPreludeFiles(backendPath, clientPath string) Option {
+	return func(c *config) {
+		c.backendPreludeFile = backendPath
+		c.clientPreludeFile = clientPath
+	}
+}
+
+// WithUserTimeout sets the TCP user timeout of inbound and outbound connections, the
+// maximum duration that sent data may remain unacknowledged before the kernel closes
+// the connection. It is only supported on Linux. Zero uses the system default.
+func WithUserTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		c.userTimeout = timeout
+	}
+}
+
+// WithEstablishedAfter sets the duration that inbound connections must live, unless they
+// exchange bytes, before they are counted as established. Connections that end sooner
+// without exchanging bytes, such as TCP health checks, are counted as probes instead.
+// Zero counts every inbound connection as established when it is accepted.
+func WithEstablishedAfter(threshold time.Duration) Option {
+	return func(c *config) {
+		c.establishedAfter = threshold
+	}
+}
+
+// WithInlineCopy sets whether bytes from the client are copied in the goroutine handling
+// the connection rather than in a goroutine of their own, saving one goroutine per connection.
+func WithInlineCopy(inline bool) Option {
+	return func(c *config) {
+		c.inlineCopy = inline
+	}
+}
+
+// WithStallBufferSize sets the size in bytes of the buffer per direction that
+// absorbs short stalls writing to either side of a connection. Zero disables buffering.
+func WithStallBufferSize(size int) Option {
+	return func(c *config) {
+		c.stallBufferSize = size
+	}
+}
+
+// WithTerminationGrace sets the termination grace period given to the proxy by its
+// orchestrator after it is asked to stop. Graceful draining is cut short just before
+// the grace period ends, so that the proxy exits cleanly before being killed.
+// Zero drains without a deadline.
+func WithTerminationGrace(grace time.Duration) Option {
+	return func(c *config) {
+		c.terminationGrace = grace
+	}
+}
+
+// WithDrainLogInterval sets the initial interval between logs of connections
+// being drained during a graceful stop. The interval doubles after each log.
+// Zero disables drain progress logs.
+func WithDrainLogInterval(interval time.Duration) Option {
+	return func(c *config) {
+		c.drainLogInterval = interval
+	}
+}
+
+// WithDrainIdleTimeout sets the duration after which a connection that has not read
+// bytes from either side is closed while draining during a graceful stop, so that idle
+// keep-alive connections do not hold up the drain. Zero waits for idle connections too.
+func WithDrainIdleTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		c.drainIdleTimeout = timeout
+	}
+}
+
+// WithMaxHeaderBytes sets the maximum number of bytes read while looking for the end
+// of a peeked header. Connections whose header exceeds the maximum are closed.
+func WithMaxHeaderBytes(max int) Option {
+	return func(c *config) {
+		c.maxHeaderBytes = max
+	}
+}
+
+// WithMinRate sets the minimum rate in bytes per second that clients must send at
+// while sending, after the passed grace period. Clients sending slower are closed,
+// while idle clients that send nothing are not. Zero disables the minimum rate.
+func WithMinRate(rate int, grace time.Duration) Option {
+	return func(c *config) {
+		c.minRate = rate
+		c.minRateGrace = grace
+	}
+}
+
+// NewConfig returns a new config having the passed addresses and options.
+func NewConfig(listenAddress, targetAddress, metricsAddress string, opts ...Option) config {
+	c := config{
+		listenAddress:    listenAddress,
+		targetAddress:    targetAddress,
+		metricsAddress:   metricsAddress,
+		logLevelName:     levelInfo.String(),
+		logSampleRate:    1,
+		noHealthyTargets: noHealthyTargetsTryAll,
+		maxSubnetLabels:  256,
+		drainLogInterval: 5 * time.Second,
+		dialTimeout:      outboundConnTimeout,
+		maxHeaderBytes:   64 * 1024,
+		linger:           -1,
+		acceptWorkers:    1,
+		mode:             modeProxy,
+		targetIPFamily:   targetIPFamilyIPv4,
+	}
+
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	return c
+}
+
+// Validate returns an error if the config or its targets file is not valid.
+// It does not bind any addresses.
+func (c config) Validate() error {
+	err := c.parse()
+	if err != nil {
+		return err
+	}
+
+	if c.targetsFile != "" {
+		_, _, err = readTargetsFile(c.targetsFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // parse parses this config.
 // Returns an error if its values are not parsable.
 func (c *config) parse() error {
@@ -41,10 +728,301 @@ func (c *config) parse() error {
 		return err
 	}
 
-	c.metricsHost, c.metricsPort, err = net.SplitHostPort(c.metricsAddress)
+	if c.fallbackTarget != "" {
+		_, _, err = net.SplitHostPort(c.fallbackTarget)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.dialTimeout <= 0 {
+		return fmt.Errorf("invalid dial timeout %v: must be positive", c.dialTimeout)
+	}
+
+	// An empty metrics address disables the prometheus metrics server
+	if c.metricsAddress != "" {
+		c.metricsHost, c.metricsPort, err = net.SplitHostPort(c.metricsAddress)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.metricsAuth != "" {
+		i := strings.Index(c.metricsAuth, ":")
+		if i < 1 {
+			return fmt.Errorf("invalid metrics auth: must be in user:pass form")
+		}
+		c.metricsUsername, c.metricsPassword = c.metricsAuth[:i], c.metricsAuth[i+1:]
+	}
+
+	if c.metricsUsername != "" && c.metricsBearerToken != "" {
+		return fmt.Errorf("invalid metrics auth: basic auth and bearer token are mutually exclusive")
+	}
+
+	if (c.metricsTLSCert == "") != (c.metricsTLSKey == "") {
+		return fmt.Errorf("invalid metrics TLS: certificate and key must be set together")
+	}
+
+	if c.statsdAddress != "" {
+		_, _, err = net.SplitHostPort(c.statsdAddress)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.logLevel, err = parseLogLevel(c.logLevelName)
 	if err != nil {
 		return err
 	}
 
+	if c.logSampleRate < 1 {
+		return fmt.Errorf("invalid log sample rate %d: must be at least 1", c.logSampleRate)
+	}
+
+	c.constLabels, err = parseLabels(c.labels)
+	if err != nil {
+		return err
+	}
+	if c.name != "" {
+		if _, ok := c.constLabels[nameLabel]; ok {
+			return fmt.Errorf("invalid label %q: label %q is set by the name of the proxy", nameLabel, nameLabel)
+		}
+		c.constLabels[nameLabel] = c.name
+	}
+
+	switch c.targetIPFamily {
+	case targetIPFamilyAuto:
+		c.targetNetwork = "tcp"
+	case targetIPFamilyIPv4:
+		c.targetNetwork = "tcp4"
+	case targetIPFamilyIPv6:
+		c.targetNetwork = "tcp6"
+	default:
+		return fmt.Errorf("invalid target IP family %q: must be one of %s, %s, %s",
+			c.targetIPFamily, targetIPFamilyAuto, targetIPFamilyIPv4, targetIPFamilyIPv6)
+	}
+
+	if c.bindAddress != "" {
+		c.bindIP = net.ParseIP(c.bindAddress)
+		if c.bindIP == nil {
+			return fmt.Errorf("invalid bind address %q: must be an IP address", c.bindAddress)
+		}
+
+		isIPv4 := c.bindIP.To4() != nil
+		if (isIPv4 && c.targetIPFamily == targetIPFamilyIPv6) || (!isIPv4 && c.targetIPFamily == targetIPFamilyIPv4) {
+			return fmt.Errorf("invalid bind address %q: must be an address of target IP family %s",
+				c.bindAddress, c.targetIPFamily)
+		}
+	}
+
+	if (c.listenNetns != "" || c.targetNetns != "") && !netnsSupported {
+		return fmt.Errorf("invalid network namespace: network namespaces are only supported on Linux")
+	}
+
+	if c.transparentDest && !originalDstSupported {
+		return fmt.Errorf("invalid transparent destination: original destinations are only supported on Linux")
+	}
+
+	if c.transparentDest && c.targetResolver != nil {
+		return fmt.Errorf("invalid transparent destination: must not be combined with a target resolver")
+	}
+
+	if c.ttl < 0 || c.ttl > 255 {
+		return fmt.Errorf("invalid TTL %d: must be between 0 and 255", c.ttl)
+	}
+
+	if c.reloadDrain < 0 {
+		return fmt.Errorf("invalid reload drain %v: must not be negative", c.reloadDrain)
+	}
+
+	if c.unhealthyDrain < 0 || c.unhealthyDrain >= unhealthyTargetCooldown {
+		return fmt.Errorf("invalid unhealthy drain %v: must be at least 0 and less than the %v unhealthy target cooldown",
+			c.unhealthyDrain, unhealthyTargetCooldown)
+	}
+
+	if c.immediateCloseWindow < 0 {
+		return fmt.Errorf("invalid immediate close window %v: must not be negative", c.immediateCloseWindow)
+	}
+
+	if c.probe != "" && c.probeResponse == "" {
+		return fmt.Errorf("invalid per-connection probe: must be set together with its expected response")
+	}
+
+	if c.probe != "" && c.probeTimeout <= 0 {
+		return fmt.Errorf("invalid per-connection probe timeout %v: must be positive", c.probeTimeout)
+	}
+
+	if c.tcpFastOpen && c.immediateCloseWindow > 0 {
+		return fmt.Errorf("invalid TCP Fast Open: cannot be combined with immediate close detection, " +
+			"since outbound connections are not established until bytes are sent")
+	}
+
+	if c.faultDropRate < 0 || c.faultDropRate > 1 {
+		return fmt.Errorf("invalid fault drop rate %v: must be between 0 and 1", c.faultDropRate)
+	}
+
+	if c.faultDelay < 0 {
+		return fmt.Errorf("invalid fault delay %v: must not be negative", c.faultDelay)
+	}
+
+	if c.asymmetryThreshold != 0 && c.asymmetryThreshold < 1 {
+		return fmt.Errorf("invalid asymmetry threshold %v: must be 0 or at least 1", c.asymmetryThreshold)
+	}
+
+	if c.globalRateLimit < 0 {
+		return fmt.Errorf("invalid global rate limit %d: must not be negative", c.globalRateLimit)
+	}
+
+	if c.maxAcceptRate < 0 {
+		return fmt.Errorf("invalid max accept rate %v: must not be negative", c.maxAcceptRate)
+	}
+
+	if c.tarpit < 0 {
+		return fmt.Errorf("invalid tarpit %v: must not be negative", c.tarpit)
+	}
+
+	if c.tarpit > 0 && c.maxTarpit < 1 {
+		return fmt.Errorf("invalid max tarpit %d: must be at least 1", c.maxTarpit)
+	}
+
+	if c.acceptWorkers < 1 {
+		return fmt.Errorf("invalid accept workers %d: must be at least 1", c.acceptWorkers)
+	}
+
+	if c.linger < -1 {
+		return fmt.Errorf("invalid linger %d: must be at least -1", c.linger)
+	}
+
+	if c.dnsServer != "" {
+		host, _, err := net.SplitHostPort(c.dnsServer)
+		if err != nil {
+			return err
+		}
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("invalid DNS server %q: host must be an IP address", c.dnsServer)
+		}
+	}
+
+	if c.maxHeaderBytes < 1 {
+		return fmt.Errorf("invalid max header bytes %d: must be at least 1", c.maxHeaderBytes)
+	}
+
+	if c.minRate < 0 {
+		return fmt.Errorf("invalid min rate %d: must not be negative", c.minRate)
+	}
+
+	if c.minRateGrace < 0 {
+		return fmt.Errorf("invalid min rate grace %v: must not be negative", c.minRateGrace)
+	}
+
+	if c.logRate < 0 {
+		return fmt.Errorf("invalid log rate %d: must not be negative", c.logRate)
+	}
+
+	if c.writeTimeout < 0 {
+		return fmt.Errorf("invalid write timeout %v: must not be negative", c.writeTimeout)
+	}
+
+	if c.maxHalfOpen < 0 {
+		return fmt.Errorf("invalid max half open %d: must not be negative", c.maxHalfOpen)
+	}
+
+	if c.userTimeout < 0 || c.userTimeout > math.MaxInt32*time.Millisecond {
+		return fmt.Errorf("invalid user timeout %v: must be between 0 and %v", c.userTimeout, math.MaxInt32*time.Millisecond)
+	}
+
+	if c.establishedAfter < 0 {
+		return fmt.Errorf("invalid established after %v: must not be negative", c.establishedAfter)
+	}
+
+	if c.terminationGrace < 0 {
+		return fmt.Errorf("invalid termination grace %v: must not be negative", c.terminationGrace)
+	}
+
+	if c.drainLogInterval < 0 {
+		return fmt.Errorf("invalid drain log interval %v: must not be negative", c.drainLogInterval)
+	}
+
+	if c.drainIdleTimeout < 0 {
+		return fmt.Errorf("invalid drain idle timeout %v: must not be negative", c.drainIdleTimeout)
+	}
+
+	if c.firstByteTimeout < 0 {
+		return fmt.Errorf("invalid first byte timeout %v: must not be negative", c.firstByteTimeout)
+	}
+
+	if c.maxSessionDuration < 0 {
+		return fmt.Errorf("invalid max session duration %v: must not be negative", c.maxSessionDuration)
+	}
+
+	if c.maxSubnetLabels < 0 {
+		return fmt.Errorf("invalid max subnet labels %d: must not be negative", c.maxSubnetLabels)
+	}
+
+	if c.stallBufferSize < 0 {
+		return fmt.Errorf("invalid stall buffer size %d: must not be negative", c.stallBufferSize)
+	}
+
+	for _, filter := range c.filters {
+		if filter == nil {
+			return fmt.Errorf("invalid connection filter: must not be nil")
+		}
+	}
+
+	for _, transformer := range c.transformers {
+		if transformer == nil {
+			return fmt.Errorf("invalid stream transformer: must not be nil")
+		}
+	}
+
+	switch c.accessLog {
+	case "", accessLogCommon, accessLogCombined:
+	default:
+		return fmt.Errorf("invalid access log format %q: must be one of %s, %s",
+			c.accessLog, accessLogCommon, accessLogCombined)
+	}
+
+	switch c.mode {
+	case modeProxy, modeEcho, modeDiscard:
+	default:
+		return fmt.Errorf("invalid mode %q: must be one of %s, %s, %s",
+			c.mode, modeProxy, modeEcho, modeDiscard)
+	}
+
+	switch c.noHealthyTargets {
+	case noHealthyTargetsReject, noHealthyTargetsTryAll:
+	default:
+		return fmt.Errorf("invalid no healthy targets behavior %q: must be one of %s, %s",
+			c.noHealthyTargets, noHealthyTargetsReject, noHealthyTargetsTryAll)
+	}
+
 	return nil
 }
+
+// parseLabels parses the passed key=value labels into prometheus labels.
+// Returns an error if a label is malformed, has an invalid name, is repeated,
+// or has the name of a label of the proxy's metrics.
+func parseLabels(labels []string) (prometheus.Labels, error) {
+	parsed := make(prometheus.Labels, len(labels))
+	for _, label := range labels {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid label %q: must be in key=value form", label)
+		}
+
+		name, value := parts[0], parts[1]
+		if !labelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid label %q: %q is not a valid label name", label, name)
+		}
+		if _, ok := reservedLabels[name]; ok {
+			return nil, fmt.Errorf("invalid label %q: label %q is used by the proxy's metrics", name, name)
+		}
+		if _, ok := parsed[name]; ok {
+			return nil, fmt.Errorf("invalid label %q: label %q is repeated", label, name)
+		}
+
+		parsed[name] = value
+	}
+
+	return parsed, nil
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		labels  []string
+		want    prometheus.Labels
+		wantErr string
+	}{
+		{
+			name:   "none",
+			labels: nil,
+			want:   prometheus.Labels{},
+		},
+		{
+			name:   "valid",
+			labels: []string{"env=prod", "region=us-east-1", "empty="},
+			want:   prometheus.Labels{"env": "prod", "region": "us-east-1", "empty": ""},
+		},
+		{
+			name:   "value containing equals sign",
+			labels: []string{"query=a=b"},
+			want:   prometheus.Labels{"query": "a=b"},
+		},
+		{
+			name:    "missing value",
+			labels:  []string{"env"},
+			wantErr: `invalid label "env": must be in key=value form`,
+		},
+		{
+			name:    "invalid name",
+			labels:  []string{"1env=prod"},
+			wantErr: `invalid label "1env=prod": "1env" is not a valid label name`,
+		},
+		{
+			name:    "reserved prefix",
+			labels:  []string{"__env=prod"},
+			wantErr: `invalid label "__env=prod": "__env" is not a valid label name`,
+		},
+		{
+			name:    "repeated",
+			labels:  []string{"env=prod", "env=dev"},
+			wantErr: `invalid label "env=dev": label "env" is repeated`,
+		},
+		{
+			name:    "variable label of the metrics",
+			labels:  []string{"id=x"},
+			wantErr: `invalid label "id": label "id" is used by the proxy's metrics`,
+		},
+		{
+			name:    "histogram bucket label",
+			labels:  []string{"le=x"},
+			wantErr: `invalid label "le": label "le" is used by the proxy's metrics`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLabels(tt.labels)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got labels %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
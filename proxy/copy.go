@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// copyContext copies bytes from the passed reader to the passed writer until either
+// EOF is reached on the reader, an error occurs, or the passed context is done.
+// The context is checked between reads, so a blocked read or write is only
+// interrupted by a deadline on the connection, as set by interruptOnDone.
+// Returns the number of bytes written and the first error encountered.
+func copyContext(ctx context.Context, writer io.Writer, reader io.Reader) (int64, error) {
+	buf := make([]byte, copyChunkSize)
+	bufferMemoryGauge.WithLabelValues(id).Add(copyChunkSize)
+	defer bufferMemoryGauge.WithLabelValues(id).Sub(copyChunkSize)
+	var written int64
+	for {
+		err := ctx.Err()
+		if err != nil {
+			return written, err
+		}
+
+		n, err := reader.Read(buf)
+		if n > 0 {
+			w, writeErr := writer.Write(buf[:n])
+			written += int64(w)
+			if writeErr != nil {
+				return written, writeErr
+			}
+			if w != n {
+				return written, io.ErrShortWrite
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// interruptOnDone sets a deadline in the past on the passed connections once the
+// passed context is done, which interrupts any blocked reads and writes on them.
+// The returned function stops watching the context and must be called once the
+// connections are no longer in use.
+func interruptOnDone(ctx context.Context, conns ...net.Conn) func() {
+	stopCh := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			for _, conn := range conns {
+				_ = conn.SetDeadline(time.Unix(1, 0))
+			}
+		case <-stopCh:
+		}
+	}()
+
+	return func() {
+		close(stopCh)
+	}
+}
+
+// resetOnDone resets the passed connections once the passed context is done, closing
+// them with SO_LINGER set to 0 so that their peers receive an RST rather than a FIN,
+// which also interrupts any blocked reads and writes on them. The returned function
+// stops watching the context and must be called once the connections are no longer in use.
+func resetOnDone(ctx context.Context, conns ...net.Conn) func() {
+	stopCh := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			for _, conn := range conns {
+				if tcpConn, ok := conn.(*net.TCPConn); ok {
+					_ = tcpConn.SetLinger(0)
+				}
+				_ = conn.Close()
+			}
+		case <-stopCh:
+		}
+	}()
+
+	return func() {
+		close(stopCh)
+	}
+}
+
+// awaitReset waits up to the forceful reset timeout for the connections interrupted
+// by a forceful stop to be closed, if the proxy is configured to reset them, so that
+// they are reset before the process exits rather than closed by the kernel with a FIN.
+func (p *proxy) awaitReset() {
+	if !p.config.forcefulReset {
+		return
+	}
+
+	deadline := time.Now().Add(forcefulResetTimeout)
+	for atomic.LoadInt64(&activeInboundConnCount) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// awaitHandlers waits up to the handler wait timeout for the connections interrupted by a
+// stop to finish being handled, if an audit log is configured, so that the records of the
+// connections cut short by the stop are written before the audit log is closed.
+func (p *proxy) awaitHandlers() {
+	if p.audit == nil {
+		return
+	}
+
+	deadline := time.Now().Add(handlerWaitTimeout)
+	for atomic.LoadInt64(&p.handling) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// stopOnDone interrupts the passed connections once the passed context is done, by resetting
+// them if the proxy is configured to reset connections on a forceful stop, or otherwise by
+// interrupting their blocked reads and writes. The returned function stops watching the
+// context and must be called once the connections are no longer in use.
+func (p *proxy) stopOnDone(ctx context.Context, conns ...net.Conn) func() {
+	if p.config.forcefulReset {
+		return resetOnDone(ctx, conns...)
+	}
+	return interruptOnDone(ctx, conns...)
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+const (
+	// benchmarkStreamSize is the number of bytes proxied by each iteration of a copy benchmark.
+	benchmarkStreamSize = 64 * 1024 * 1024
+
+	// benchmarkWriteSize is the number of bytes written to the proxy per write.
+	benchmarkWriteSize = 32 * 1024
+)
+
+// pipeConn is an in-memory half of a connection that reads from and writes to pipes.
+type pipeConn struct {
+	reader *io.PipeReader
+	writer *io.PipeWriter
+}
+
+func (c pipeConn) Read(b []byte) (int, error)  { return c.reader.Read(b) }
+func (c pipeConn) Write(b []byte) (int, error) { return c.writer.Write(b) }
+func (c pipeConn) CloseRead() error            { return c.reader.Close() }
+func (c pipeConn) CloseWrite() error           { return c.writer.Close() }
+
+func BenchmarkCopy(b *testing.B) {
+	b.Run("unbuffered", func(b *testing.B) {
+		benchmarkCopy(b, NewConfig("", "", ""))
+	})
+	b.Run("stall-buffer", func(b *testing.B) {
+		benchmarkCopy(b, NewConfig("", "", "", WithStallBufferSize(1024*1024)))
+	})
+}
+
+// benchmarkCopy measures the throughput of proxying a large stream between
+// in-memory pipes with a proxy having the passed config, reported in MB/s.
+func benchmarkCopy(b *testing.B, c config) {
+	p := &proxy{
+		config: c,
+		logger: newLogger(levelError),
+	}
+	chunk := make([]byte, benchmarkWriteSize)
+
+	b.SetBytes(benchmarkStreamSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		srcReader, srcWriter := io.Pipe()
+		dstReader, dstWriter := io.Pipe()
+
+		// Write the stream to the source and drain the destination
+		go func() {
+			for written := 0; written < benchmarkStreamSize; written += len(chunk) {
+				_, _ = srcWriter.Write(chunk)
+			}
+			_ = srcWriter.Close()
+		}()
+		drainedCh := make(chan int64, 1)
+		go func() {
+			n, _ := io.Copy(ioutil.Discard, dstReader)
+			drainedCh <- n
+		}()
+
+		resultCh := make(chan copyResult, 1)
+		p.copy(context.Background(), pipeConn{writer: dstWriter}, pipeConn{reader: srcReader}, ClientToBackend, resultCh)
+		result := <-resultCh
+		drained := <-drainedCh
+		if result.bytes != benchmarkStreamSize || drained != benchmarkStreamSize {
+			b.Fatalf("copied %d bytes and drained %d bytes, want %d",
+				result.bytes, drained, benchmarkStreamSize)
+		}
+	}
+}
+
+func TestCopyCanceled(t *testing.T) {
+	p := &proxy{
+		config: NewConfig("", "", ""),
+		logger: newLogger(levelError),
+	}
+	client, inbound := tcpConnPair(t)
+	outbound, server := tcpConnPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopInterrupt := interruptOnDone(ctx, inbound, outbound)
+	defer stopInterrupt()
+	resultCh := make(chan copyResult, 1)
+	go p.copy(ctx, outbound, inbound, ClientToBackend, resultCh)
+
+	// Copy some bytes, then cancel while the copy is blocked reading more
+	sent := []byte("hello")
+	_, err := client.Write(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make([]byte, len(sent))
+	_, err = io.ReadFull(server, received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	select {
+	case result := <-resultCh:
+		if result.bytes != int64(len(sent)) {
+			t.Errorf("copied %d bytes, want %d", result.bytes, len(sent))
+		}
+		if !result.partial {
+			t.Error("copy ended on EOF, want it to end on cancellation")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("copy was not interrupted by cancellation")
+	}
+}
+
+// steadyReader is a reader that never ends, filling the passed buffer after a short
+// delay like a client that keeps sending, so that the writer always keeps up with it.
+type steadyReader struct{}
+
+func (steadyReader) Read(b []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	return len(b), nil
+}
+
+// failingWriter is a writer whose writes always fail.
+type failingWriter struct{}
+
+func (failingWriter) Write(b []byte) (int, error) { return 0, errors.New("write failed") }
+
+func TestBufferedCopyStopsReadingOnWriteError(t *testing.T) {
+	p := &proxy{
+		config: NewConfig("", "", "", WithStallBufferSize(64*1024)),
+		logger: newLogger(levelError),
+	}
+
+	// The reader never ends, so the copy only returns if it stops reading once the writer fails
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := p.bufferedCopy(failingWriter{}, steadyReader{})
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Error("copy succeeded, want the write error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("copy kept reading after the writer failed")
+	}
+}
+
+func TestFaultConnDropsAfterOffset(t *testing.T) {
+	reader, writer := io.Pipe()
+	go func() {
+		for {
+			_, err := writer.Write(make([]byte, 4))
+			if err != nil {
+				return
+			}
+		}
+	}()
+	defer reader.Close()
+
+	dropped := 0
+	dropper := &faultDropper{remaining: 10, drop: func() { dropped++ }}
+	conn := &faultConn{halfCloser: pipeConn{reader: reader}, ctx: context.Background(), dropper: dropper}
+
+	// Every byte up to the offset must be read before the connection is dropped
+	read, err := io.Copy(ioutil.Discard, conn)
+	if read != 10 {
+		t.Errorf("read %d bytes before the drop, want 10", read)
+	}
+	if !errors.Is(err, errFaultDropped) || dropped != 1 {
+		t.Errorf("got error %v after %d drops, want the connection to be dropped once", err, dropped)
+	}
+}
+
+// tcpConnPair returns both ends of a new TCP connection over the loopback interface.
+func tcpConnPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.Listen(networkType, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	dialed, err := net.Dial(networkType, listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dialed.(*net.TCPConn), accepted.(*net.TCPConn)
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+	"time"
+)
+
+const (
+	// dialOutcomeWindow is the number of seconds of dial outcomes that the dial success ratio is
+	// computed over, each second of outcomes being counted in a bucket of its own.
+	dialOutcomeWindow = 60
+)
+
+// dialOutcomes counts the inbound connections that did and did not establish an outbound
+// connection over a sliding window of the last dialOutcomeWindow seconds.
+// It is safe for concurrent use.
+type dialOutcomes struct {
+	mu        sync.Mutex
+	seconds   [dialOutcomeWindow]int64
+	successes [dialOutcomeWindow]int64
+	failures  [dialOutcomeWindow]int64
+}
+
+// add counts the outcome of dialing the outbound connection of an inbound connection.
+func (d *dialOutcomes) add(success bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now().Unix()
+	i := now % dialOutcomeWindow
+	if d.seconds[i] != now {
+		// Reuse the bucket of the second that has left the window
+		d.seconds[i] = now
+		d.successes[i] = 0
+		d.failures[i] = 0
+	}
+
+	if success {
+		d.successes[i]++
+	} else {
+		d.failures[i]++
+	}
+}
+
+// ratio returns the proportion of inbound connections in the window that established
+// an outbound connection, or 1 if no outbound connections were dialed in the window.
+func (d *dialOutcomes) ratio() float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now().Unix()
+	var successes, failures int64
+	for i := range d.seconds {
+		if now-d.seconds[i] < dialOutcomeWindow {
+			successes += d.successes[i]
+			failures += d.failures[i]
+		}
+	}
+
+	if successes+failures == 0 {
+		return 1
+	}
+	return float64(successes) / float64(successes+failures)
+}
+
+// dialOutcomeCollectors returns a prometheus collector of the dial success ratio, which is
+// computed from the dial outcomes in the window each time the metrics are collected.
+func (p *proxy) dialOutcomeCollectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "dial_success_ratio",
+			Help:        "The proportion of inbound connections that established an outbound connection over the last minute",
+			ConstLabels: prometheus.Labels{"id": id},
+		}, func() float64 {
+			if p.dials == nil {
+				return 1
+			}
+			return p.dials.ratio()
+		}),
+	}
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// connActivity tracks the last time bytes were read from either side of a proxied
+// connection, so that idle connections can be closed while the proxy is draining.
+type connActivity struct {
+	last    int64
+	closeFn func()
+}
+
+// touch records that bytes were just read from the connection.
+func (a *connActivity) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+// idleFor returns how long it has been since bytes were last read from the connection.
+func (a *connActivity) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&a.last)))
+}
+
+// activityConn is a connection that records its reads in a connActivity.
+type activityConn struct {
+	halfCloser
+	activity *connActivity
+}
+
+// Read reads bytes from the connection and records the activity if any were read.
+func (c *activityConn) Read(b []byte) (int, error) {
+	n, err := c.halfCloser.Read(b)
+	if n > 0 {
+		c.activity.touch()
+	}
+	return n, err
+}
+
+// trackActivity tracks the activity of a proxied connection while it is active, so
+// that it can be closed if it is idle while the proxy is draining. The passed close
+// function closes both sides of the connection. The returned function stops tracking it.
+func (p *proxy) trackActivity(activity *connActivity, closeFn func()) func() {
+	activity.touch()
+	activity.closeFn = closeFn
+	p.activity.Store(activity, struct{}{})
+	return func() {
+		p.activity.Delete(activity)
+	}
+}
+
+// closeIdleConns closes the proxied connections that have not read bytes from
+// either side for the configured drain idle timeout. Returns the number closed.
+func (p *proxy) closeIdleConns() int {
+	closed := 0
+	p.activity.Range(func(key, _ interface{}) bool {
+		activity := key.(*connActivity)
+		if activity.idleFor() >= p.config.drainIdleTimeout {
+			p.activity.Delete(activity)
+			drainIdleClosedCounter.WithLabelValues(id).Inc()
+			activity.closeFn()
+			closed++
+		}
+		return true
+	})
+	return closed
+}
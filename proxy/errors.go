@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+const (
+	// dialFailureTimeout is the dial failure reason of dials that timed out.
+	dialFailureTimeout = "timeout"
+
+	// dialFailureRefused is the dial failure reason of dials refused by the target.
+	dialFailureRefused = "refused"
+
+	// dialFailureNoRoute is the dial failure reason of dials to unreachable hosts or networks.
+	dialFailureNoRoute = "no_route"
+
+	// dialFailureOther is the dial failure reason of dials that failed for any other reason.
+	dialFailureOther = "other"
+)
+
+// bindError returns an actionable error if the passed error is the result of
+// the passed address already being in use. Otherwise, the error is returned unchanged.
+func bindError(err error, name, address string) error {
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return fmt.Errorf("unable to bind %s address %s: the port is already in use by another process; "+
+			"stop that process or choose a different port: %w", name, address, err)
+	}
+
+	return err
+}
+
+// isExpectedCloseError returns true if the passed error is the expected result of half-closing
+// a connection that is already closed, or whose peer has already reset it, during teardown.
+func isExpectedCloseError(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.ENOTCONN)
+}
+
+// isDNSError returns true if the passed error is the result of failing to resolve a name.
+func isDNSError(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr)
+}
+
+// dialFailureReason classifies the passed dial error, so that a slow target
+// can be told apart from a target that is down.
+func dialFailureReason(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return dialFailureTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return dialFailureRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return dialFailureNoRoute
+	default:
+		return dialFailureOther
+	}
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// establishingConn is an inbound connection that has not yet been counted as
+// established. It is counted once, either when its timer fires after the
+// configured threshold or when it ends having exchanged bytes.
+type establishingConn struct {
+	once  sync.Once
+	timer *time.Timer
+}
+
+// countEstablished counts an inbound connection as established.
+func (p *proxy) countEstablished() {
+	inboundConnCounter.WithLabelValues(id).Inc()
+	p.statsd.count("inbound_connection_count", 1)
+}
+
+// trackInbound counts the passed accepted connection as established. If an
+// established threshold is configured, counting is deferred until the
+// connection outlives the threshold or ends having exchanged bytes.
+func (p *proxy) trackInbound(conn net.Conn) {
+	if p.config.establishedAfter == 0 {
+		p.countEstablished()
+		return
+	}
+
+	ec := &establishingConn{}
+	ec.timer = time.AfterFunc(p.config.establishedAfter, func() {
+		ec.once.Do(p.countEstablished)
+	})
+	p.establishing.Store(conn, ec)
+}
+
+// settleInbound settles the counting of the passed ending connection. A connection
+// that exchanged bytes is counted as established if it was not already, and one that
+// ended before the established threshold without exchanging bytes is counted as a probe.
+func (p *proxy) settleInbound(conn net.Conn, exchanged bool) {
+	v, ok := p.establishing.Load(conn)
+	if !ok {
+		return
+	}
+	p.establishing.Delete(conn)
+
+	ec := v.(*establishingConn)
+	ec.timer.Stop()
+	if exchanged {
+		ec.once.Do(p.countEstablished)
+	}
+	ec.once.Do(func() {
+		probeConnCounter.WithLabelValues(id).Inc()
+	})
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// faultDrop is the fault label of connections dropped mid-stream.
+	faultDrop = "drop"
+
+	// faultDelay is the fault label of reads delayed by the fault delay.
+	faultDelay = "delay"
+
+	// maxFaultDropOffset is the most bytes that a connection selected to be dropped
+	// proxies before it is dropped. The offset of each connection is chosen at random
+	// up to this many bytes, counting the bytes proxied in both directions.
+	maxFaultDropOffset = 16 * 1024
+)
+
+var (
+	errFaultDropped = errors.New("connection dropped by fault injection")
+)
+
+// faultInjector injects faults into proxied connections for chaos testing.
+// Its random number generator is seeded so that the connections selected
+// to be dropped can be reproduced. It is safe for concurrent use.
+type faultInjector struct {
+	mu       sync.Mutex
+	rand     *rand.Rand
+	dropRate float64
+	delay    time.Duration
+}
+
+// newFaultInjector returns a new fault injector that drops connections with the passed
+// probability and delays reads by the passed delay, seeded with the passed seed.
+func newFaultInjector(dropRate float64, delay time.Duration, seed int64) *faultInjector {
+	return &faultInjector{
+		rand:     rand.New(rand.NewSource(seed)),
+		dropRate: dropRate,
+		delay:    delay,
+	}
+}
+
+// dropOffset returns the number of bytes after which the next connection should be
+// dropped mid-stream, and true if it was selected to be dropped.
+func (f *faultInjector) dropOffset() (int64, bool) {
+	if f.dropRate == 0 {
+		return 0, false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rand.Float64() >= f.dropRate {
+		return 0, false
+	}
+	return 1 + f.rand.Int63n(maxFaultDropOffset), true
+}
+
+// faultDropper drops a connection once a number of bytes have been proxied in either
+// direction. It is shared by both directions of the connection.
+type faultDropper struct {
+	remaining int64
+	drop      func()
+}
+
+// faultConn is a connection whose reads are delayed by a fixed delay, and that
+// calls the drop function of its dropper once the dropper's bytes are proxied.
+type faultConn struct {
+	halfCloser
+	ctx     context.Context
+	delay   time.Duration
+	dropper *faultDropper
+}
+
+// Read waits for the delay before reading from the underlying connection, unless the
+// context is done first. If the connection has a dropper, reads are limited to the
+// bytes remaining before the drop, so that those bytes are proxied in full, and the
+// read following them drops the connection instead of reading.
+func (c *faultConn) Read(b []byte) (int, error) {
+	if c.delay > 0 {
+		faultsInjectedCounter.WithLabelValues(id, faultDelay).Inc()
+		timer := time.NewTimer(c.delay)
+		select {
+		case <-timer.C:
+		case <-c.ctx.Done():
+			timer.Stop()
+		}
+	}
+
+	if c.dropper == nil {
+		return c.halfCloser.Read(b)
+	}
+
+	remaining := atomic.LoadInt64(&c.dropper.remaining)
+	if remaining <= 0 {
+		c.dropper.drop()
+		return 0, errFaultDropped
+	}
+	if int64(len(b)) > remaining {
+		b = b[:remaining]
+	}
+
+	n, err := c.halfCloser.Read(b)
+	atomic.AddInt64(&c.dropper.remaining, -int64(n))
+	return n, err
+}
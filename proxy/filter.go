@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"net"
+)
+
+const (
+	// rejectReasonFiltered is the reject reason of connections rejected by a
+	// connection filter that did not return a reason of its own.
+	rejectReasonFiltered = "filtered"
+)
+
+// ConnectionFilter decides whether an accepted connection is proxied, allowing
+// custom logic such as access control to be added to the proxy without forking it.
+// Filters are called from the accept loop before each connection is handled, so
+// Allow must be safe for concurrent use and should return quickly.
+type ConnectionFilter interface {
+	// Allow returns true if the passed connection may be proxied. Otherwise it
+	// returns false and the reason the connection is rejected, which labels the
+	// connections_rejected_total metric and so should come from a small fixed set.
+	Allow(conn net.Conn) (bool, string)
+}
+
+// ConnectionFilterFunc is an adapter allowing an ordinary function to be used as a ConnectionFilter.
+type ConnectionFilterFunc func(conn net.Conn) (bool, string)
+
+// Allow calls f(conn).
+func (f ConnectionFilterFunc) Allow(conn net.Conn) (bool, string) {
+	return f(conn)
+}
+
+// filterConnection calls each configured connection filter in the order they were
+// registered, returning false and the reason of the first filter that rejects the
+// passed connection.
+func (p *proxy) filterConnection(conn net.Conn) (bool, string) {
+	for _, filter := range p.config.filters {
+		allowed, reason := filter.Allow(conn)
+		if !allowed {
+			if reason == "" {
+				reason = rejectReasonFiltered
+			}
+			return false, reason
+		}
+	}
+
+	return true, ""
+}
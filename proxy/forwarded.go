@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	// forwardedForHeader is the name of the HTTP header used to convey the client address.
+	forwardedForHeader = "X-Forwarded-For"
+
+	// httpPeekTimeout is how long the proxy waits for the first bytes of a client to tell
+	// whether it speaks HTTP. Clients of protocols where the server sends the first bytes
+	// send nothing, so they are forwarded untouched once it passes.
+	httpPeekTimeout = 500 * time.Millisecond
+
+	// httpHeaderTimeout is the maximum duration of reading the header of an HTTP request
+	// once its method was seen, so that clients sending it slowly cannot hold up a connection.
+	httpHeaderTimeout = 10 * time.Second
+)
+
+var (
+	errHeaderTooLarge = errors.New("request header too large")
+	errHeaderTimeout  = errors.New("request header not received in time")
+)
+
+// httpMethods are the request method tokens used to detect plaintext HTTP traffic.
+var httpMethods = [][]byte{
+	[]byte("GET "),
+	[]byte("HEAD "),
+	[]byte("POST "),
+	[]byte("PUT "),
+	[]byte("DELETE "),
+	[]byte("CONNECT "),
+	[]byte("OPTIONS "),
+	[]byte("TRACE "),
+	[]byte("PATCH "),
+}
+
+// halfCloser is a connection whose read and write sides can be closed independently.
+type halfCloser interface {
+	io.ReadWriter
+	CloseRead() error
+	CloseWrite() error
+}
+
+// bufferedConn is a TCP connection whose reads are served from reader.
+type bufferedConn struct {
+	*net.TCPConn
+	reader io.Reader
+}
+
+// Read reads bytes from the reader of this connection.
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// WriteTo writes bytes from the reader of this connection to the passed writer.
+// It prevents the embedded TCP connection's WriteTo from bypassing the reader.
+func (c *bufferedConn) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, c.reader)
+}
+
+// forwardedFor returns a connection that reads from the passed inbound connection.
+// If the first bytes read from the connection look like a plaintext HTTP request,
+// the X-Forwarded-For header of the first request is set or appended to with the
+// client IP address. Non-HTTP traffic, including clients that send nothing within
+// the peek timeout, and subsequent requests are left untouched. Returns an error if
+// the end of the request header is not found within the configured maximum number
+// of bytes or the header timeout, in which case the connection must be closed.
+func (p *proxy) forwardedFor(conn *net.TCPConn) (halfCloser, error) {
+	br := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(httpPeekTimeout))
+	if !isHTTP(br) {
+		_ = conn.SetReadDeadline(time.Time{})
+		return &bufferedConn{TCPConn: conn, reader: br}, nil
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(httpHeaderTimeout))
+	header, err := readHTTPHeader(br, p.config.maxHeaderBytes)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err == errHeaderTooLarge {
+		return nil, fmt.Errorf("%w: end of header not found within %d bytes", err, p.config.maxHeaderBytes)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return nil, fmt.Errorf("%w: end of header not found within %v", errHeaderTimeout, httpHeaderTimeout)
+	}
+	if err == nil {
+		clientIP, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err == nil {
+			header = setForwardedFor(header, clientIP)
+		}
+	} else {
+		p.logger.warnf("unable to set %s header: %v", forwardedForHeader, err)
+	}
+
+	return &bufferedConn{
+		TCPConn: conn,
+		reader:  io.MultiReader(bytes.NewReader(header), br),
+	}, nil
+}
+
+// isHTTP returns true if the bytes first received on the passed reader begin with an
+// HTTP request method token. Bytes are peeked until they either contain a method token
+// or can no longer begin with one, so a token split across segments is still detected.
+// Returns false if reading fails, e.g. when the read deadline of the connection passes.
+func isHTTP(br *bufio.Reader) bool {
+	n := 1
+	for {
+		peeked, err := br.Peek(n)
+		if err != nil {
+			return false
+		}
+
+		partial := false
+		for _, method := range httpMethods {
+			if bytes.HasPrefix(peeked, method) {
+				return true
+			}
+			if bytes.HasPrefix(method, peeked) {
+				partial = true
+			}
+		}
+		if !partial {
+			return false
+		}
+		n = len(peeked) + 1
+	}
+}
+
+// readHTTPHeader reads the request line and header lines of an HTTP request
+// from the passed reader, up to the passed maximum number of bytes. Returns the
+// bytes read and a nil error if the blank line terminating the header was found.
+// Returns errHeaderTooLarge if the header, including its terminating blank line,
+// is longer than the maximum number of bytes, or the error encountered reading.
+func readHTTPHeader(br *bufio.Reader, max int) ([]byte, error) {
+	var header []byte
+	for {
+		line, err := br.ReadSlice('\n')
+		header = append(header, line...)
+		if len(header) > max {
+			return header, errHeaderTooLarge
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return header, err
+		}
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return header, nil
+		}
+	}
+}
+
+// setForwardedFor returns the passed HTTP request header with the passed client IP
+// appended to its X-Forwarded-For header, set as its value if the header is empty,
+// or with the header added if absent. Added headers end the way the header does.
+func setForwardedFor(header []byte, clientIP string) []byte {
+	lines := bytes.SplitAfter(header, []byte("\n"))
+	prefix := []byte(forwardedForHeader + ":")
+
+	out := make([]byte, 0, len(header)+len(prefix)+len(clientIP)+4)
+	found := false
+	for i, line := range lines {
+		if i > 0 && !found && len(line) >= len(prefix) && bytes.EqualFold(line[:len(prefix)], prefix) {
+			value := bytes.TrimRight(line, "\r\n")
+			if len(bytes.TrimSpace(value[len(prefix):])) == 0 {
+				out = append(out, value[:len(prefix)]...)
+				out = append(out, " "+clientIP...)
+			} else {
+				out = append(out, value...)
+				out = append(out, ", "+clientIP...)
+			}
+			out = append(out, line[len(value):]...)
+			found = true
+			continue
+		}
+
+		// Add the header just before the blank line terminating the header,
+		// ending it with the same line ending as the blank line
+		if i > 0 && !found && len(bytes.TrimRight(line, "\r\n")) == 0 {
+			out = append(out, forwardedForHeader+": "+clientIP...)
+			out = append(out, line...)
+			found = true
+		}
+
+		out = append(out, line...)
+	}
+
+	return out
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// segmentReader is a reader that returns each of its segments from a separate read,
+// like a client whose bytes arrive in separate TCP segments, and then io.EOF.
+type segmentReader struct {
+	segments []string
+}
+
+func (r *segmentReader) Read(b []byte) (int, error) {
+	if len(r.segments) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(b, r.segments[0])
+	r.segments[0] = r.segments[0][n:]
+	if r.segments[0] == "" {
+		r.segments = r.segments[1:]
+	}
+	return n, nil
+}
+
+func TestIsHTTP(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments []string
+		want     bool
+	}{
+		{name: "request", segments: []string{"GET / HTTP/1.1\r\n"}, want: true},
+		{name: "long method", segments: []string{"OPTIONS * HTTP/1.1\r\n"}, want: true},
+		{name: "method split across segments", segments: []string{"GE", "T / HTTP/1.1\r\n"}, want: true},
+		{name: "method split into single bytes", segments: []string{"P", "O", "S", "T", " "}, want: true},
+		{name: "non-HTTP first byte", segments: []string{"\x16\x03\x01\x02\x00"}, want: false},
+		{name: "method prefix of other protocol", segments: []string{"GETX"}, want: false},
+		{name: "lowercase method", segments: []string{"get / HTTP/1.1\r\n"}, want: false},
+		{name: "partial method then EOF", segments: []string{"GE"}, want: false},
+		{name: "nothing sent", segments: nil, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := isHTTP(bufio.NewReader(&segmentReader{segments: tt.segments}))
+			if got != tt.want {
+				t.Errorf("isHTTP() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadHTTPHeader(t *testing.T) {
+	header := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	tests := []struct {
+		name    string
+		input   string
+		max     int
+		want    string
+		wantErr error
+	}{
+		{name: "CRLF", input: header + "body", max: 1024, want: header},
+		{name: "bare LF", input: "GET / HTTP/1.1\nHost: example.com\n\nbody", max: 1024,
+			want: "GET / HTTP/1.1\nHost: example.com\n\n"},
+		{name: "exactly max bytes", input: header + "body", max: len(header), want: header},
+		{name: "one byte over max", input: header + "body", max: len(header) - 1, wantErr: errHeaderTooLarge},
+		{name: "line over max", input: "GET /" + strings.Repeat("a", 8192) + " HTTP/1.1\r\n\r\n", max: 1024,
+			wantErr: errHeaderTooLarge},
+		{name: "unterminated", input: "GET / HTTP/1.1\r\nHost: example.com\r\n", max: 1024, wantErr: io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readHTTPHeader(bufio.NewReader(strings.NewReader(tt.input)), tt.max)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got header %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetForwardedFor(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{
+			name:   "absent",
+			header: "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			want:   "GET / HTTP/1.1\r\nHost: example.com\r\nX-Forwarded-For: 1.2.3.4\r\n\r\n",
+		},
+		{
+			name:   "existing",
+			header: "GET / HTTP/1.1\r\nX-Forwarded-For: 5.6.7.8\r\n\r\n",
+			want:   "GET / HTTP/1.1\r\nX-Forwarded-For: 5.6.7.8, 1.2.3.4\r\n\r\n",
+		},
+		{
+			name:   "existing with different case",
+			header: "GET / HTTP/1.1\r\nx-forwarded-for: 5.6.7.8\r\n\r\n",
+			want:   "GET / HTTP/1.1\r\nx-forwarded-for: 5.6.7.8, 1.2.3.4\r\n\r\n",
+		},
+		{
+			name:   "existing empty value",
+			header: "GET / HTTP/1.1\r\nX-Forwarded-For:\r\n\r\n",
+			want:   "GET / HTTP/1.1\r\nX-Forwarded-For: 1.2.3.4\r\n\r\n",
+		},
+		{
+			name:   "existing blank value",
+			header: "GET / HTTP/1.1\r\nX-Forwarded-For:  \r\n\r\n",
+			want:   "GET / HTTP/1.1\r\nX-Forwarded-For: 1.2.3.4\r\n\r\n",
+		},
+		{
+			name:   "only first header appended to",
+			header: "GET / HTTP/1.1\r\nX-Forwarded-For: 5.6.7.8\r\nX-Forwarded-For: 9.9.9.9\r\n\r\n",
+			want:   "GET / HTTP/1.1\r\nX-Forwarded-For: 5.6.7.8, 1.2.3.4\r\nX-Forwarded-For: 9.9.9.9\r\n\r\n",
+		},
+		{
+			name:   "bare LF absent",
+			header: "GET / HTTP/1.1\nHost: example.com\n\n",
+			want:   "GET / HTTP/1.1\nHost: example.com\nX-Forwarded-For: 1.2.3.4\n\n",
+		},
+		{
+			name:   "bare LF existing",
+			header: "GET / HTTP/1.1\nX-Forwarded-For: 5.6.7.8\n\n",
+			want:   "GET / HTTP/1.1\nX-Forwarded-For: 5.6.7.8, 1.2.3.4\n\n",
+		},
+		{
+			name:   "request line not treated as header",
+			header: "X-Forwarded-For: / HTTP/1.1\r\n\r\n",
+			want:   "X-Forwarded-For: / HTTP/1.1\r\nX-Forwarded-For: 1.2.3.4\r\n\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := setForwardedFor([]byte(tt.header), "1.2.3.4")
+			if string(got) != tt.want {
+				t.Errorf("got header %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
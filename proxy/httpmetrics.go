@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxPendingHTTPRequests is the maximum number of parsed requests awaiting a response.
+	maxPendingHTTPRequests = 64
+
+	// maxPendingHTTPWrites is the maximum number of teed reads awaiting parsing.
+	maxPendingHTTPWrites = 16
+
+	// otherHTTPMethod is the method label of requests with a non-standard method.
+	otherHTTPMethod = "OTHER"
+)
+
+var (
+	errNotHTTP = errors.New("connection is not carrying HTTP traffic")
+)
+
+// httpObserver observes the requests and responses of a plaintext HTTP connection
+// in order to count requests by method and status, and to write them to the access
+// log. Bytes copied by the proxy are teed to parsers running in their own goroutines.
+// If the bytes cannot be parsed as HTTP, the parsers stop and the bytes are no
+// longer teed.
+type httpObserver struct {
+	client     string
+	metrics    bool
+	accessLog  *accessLog
+	requestsR  *io.PipeReader
+	requestsW  *asyncWriter
+	responsesR *io.PipeReader
+	responsesW *asyncWriter
+	requests   chan observedRequest
+}
+
+// observedRequest is a parsed request awaiting its response.
+type observedRequest struct {
+	req      *http.Request
+	received time.Time
+}
+
+// newHTTPObserver returns a new httpObserver of a connection from the passed client
+// IP address. Requests are counted if metrics is true, and written to the passed
+// access log unless it is nil.
+func newHTTPObserver(client string, metrics bool, accessLog *accessLog) *httpObserver {
+	requestsR, requestsW := io.Pipe()
+	responsesR, responsesW := io.Pipe()
+	return &httpObserver{
+		client:     client,
+		metrics:    metrics,
+		accessLog:  accessLog,
+		requestsR:  requestsR,
+		requestsW:  newAsyncWriter(requestsW),
+		responsesR: responsesR,
+		responsesW: newAsyncWriter(responsesW),
+		requests:   make(chan observedRequest, maxPendingHTTPRequests),
+	}
+}
+
+// observe starts observing the passed inbound and outbound readers.
+// Returns readers that must be copied from in their place.
+func (o *httpObserver) observe(inbound, outbound halfCloser) (halfCloser, halfCloser) {
+	go o.parseRequests()
+	go o.parseResponses()
+
+	return &teeConn{halfCloser: inbound, w: o.requestsW},
+		&teeConn{halfCloser: outbound, w: o.responsesW}
+}
+
+// close stops observing the connection.
+// It must only be called once copying from the observed readers has finished.
+func (o *httpObserver) close() {
+	o.requestsW.close()
+	o.responsesW.close()
+}
+
+// parseRequests parses requests teed from the inbound connection
+// and queues them to be matched with their responses.
+func (o *httpObserver) parseRequests() {
+	defer close(o.requests)
+
+	br := bufio.NewReader(o.requestsR)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			o.requestsR.CloseWithError(errNotHTTP)
+			return
+		}
+		received := time.Now()
+
+		// Discard the request body to find the start of the next request
+		_, err = io.Copy(ioutil.Discard, req.Body)
+		if err != nil {
+			o.requestsR.CloseWithError(errNotHTTP)
+			return
+		}
+
+		select {
+		case o.requests <- observedRequest{req: req, received: received}:
+		default:
+			// The responses are not keeping up, so stop observing
+			o.requestsR.CloseWithError(errNotHTTP)
+			return
+		}
+	}
+}
+
+// parseResponses parses responses teed from the outbound connection, counting
+// each response with the method of its request and writing it to the access log.
+func (o *httpObserver) parseResponses() {
+	br := bufio.NewReader(o.responsesR)
+	for observed := range o.requests {
+		req := observed.req
+		resp, err := http.ReadResponse(br, req)
+		for err == nil && resp.StatusCode >= 100 && resp.StatusCode < 200 &&
+			resp.StatusCode != http.StatusSwitchingProtocols {
+			// Skip informational responses preceding the final response
+			resp, err = http.ReadResponse(br, req)
+		}
+		if err != nil {
+			break
+		}
+
+		if o.metrics {
+			httpRequestsCounter.WithLabelValues(id, httpMethodLabel(req.Method), strconv.Itoa(resp.StatusCode)).Inc()
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			o.logAccess(observed, resp.StatusCode, 0)
+			break
+		}
+
+		// Discard the response body to find the start of the next response
+		bytes, err := io.Copy(ioutil.Discard, resp.Body)
+		if err != nil {
+			break
+		}
+		o.logAccess(observed, resp.StatusCode, bytes)
+	}
+
+	o.responsesR.CloseWithError(errNotHTTP)
+}
+
+// logAccess writes the passed request to the access log, if one is configured.
+func (o *httpObserver) logAccess(observed observedRequest, status int, bytes int64) {
+	if o.accessLog != nil {
+		o.accessLog.log(o.client, observed.received, observed.req, status, bytes)
+	}
+}
+
+// httpMethodLabel returns the metric label for the passed request method.
+// Non-standard methods are labeled as other to bound the label cardinality.
+func httpMethodLabel(method string) string {
+	for _, m := range httpMethods {
+		if method+" " == string(m) {
+			return method
+		}
+	}
+
+	return otherHTTPMethod
+}
+
+// asyncWriter writes to a pipe from its own goroutine so that writers are never
+// blocked by a slow or stopped pipe reader. Writing stops once a write to the pipe
+// fails or the maximum number of pending writes is reached.
+type asyncWriter struct {
+	stopped int32
+	ch      chan []byte
+	w       *io.PipeWriter
+}
+
+// newAsyncWriter returns a new asyncWriter that writes to the passed pipe.
+func newAsyncWriter(w *io.PipeWriter) *asyncWriter {
+	a := &asyncWriter{
+		ch: make(chan []byte, maxPendingHTTPWrites),
+		w:  w,
+	}
+	go a.run()
+	return a
+}
+
+// Write queues a copy of the passed bytes to be written to the pipe.
+// It must not be called concurrently.
+func (a *asyncWriter) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&a.stopped) == 1 {
+		return 0, errNotHTTP
+	}
+
+	select {
+	case a.ch <- append([]byte(nil), b...):
+		return len(b), nil
+	default:
+		// Dropping bytes would corrupt the stream, so stop writing altogether
+		atomic.StoreInt32(&a.stopped, 1)
+		_ = a.w.CloseWithError(errNotHTTP)
+		return 0, errNotHTTP
+	}
+}
+
+// run writes queued bytes to the pipe until the writer is closed.
+// Once a write fails, queued bytes are drained without being written.
+func (a *asyncWriter) run() {
+	var err error
+	for b := range a.ch {
+		if err == nil {
+			_, err = a.w.Write(b)
+			if err != nil {
+				atomic.StoreInt32(&a.stopped, 1)
+			}
+		}
+	}
+	_ = a.w.Close()
+}
+
+// close closes the writer once all queued bytes have been written.
+func (a *asyncWriter) close() {
+	close(a.ch)
+}
+
+// teeConn is a connection whose reads are written to w.
+// Errors writing to w are ignored so that observing a connection
+// never interrupts copying its bytes.
+type teeConn struct {
+	halfCloser
+	w io.Writer
+}
+
+// Read reads bytes from the connection and writes them to w.
+func (c *teeConn) Read(b []byte) (int, error) {
+	n, err := c.halfCloser.Read(b)
+	if n > 0 {
+		_, _ = c.w.Write(b[:n])
+	}
+	return n, err
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"time"
+)
+
+// peekedConn is a connection whose reads are served from reader,
+// which holds bytes already peeked from the connection.
+type peekedConn struct {
+	halfCloser
+	reader io.Reader
+}
+
+// Read reads bytes from the reader of this connection.
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// waitForFirstByte blocks until the first byte is received on the passed reader of the
+// passed inbound connection, or until the first byte timeout passes. Returns a connection
+// that reads the received bytes before the rest of the reader, or the error encountered
+// if the client closed the connection or sent nothing in time. The wait is interrupted
+// if the proxy is stopped, and while draining, once the client is idle for the drain
+// idle timeout. Interrupting the read rather than closing the connection leaves it to
+// be closed by the caller, which accounts for it like any other rejected connection.
+func (p *proxy) waitForFirstByte(inboundConn net.Conn, reader halfCloser) (halfCloser, error) {
+	timeout := p.config.firstByteTimeout
+	if timeout == 0 {
+		timeout = p.config.dialTimeout
+	}
+	_ = inboundConn.SetReadDeadline(time.Now().Add(timeout))
+	defer inboundConn.SetReadDeadline(time.Time{})
+
+	stopInterrupt := interruptOnDone(p.ctx, inboundConn)
+	defer stopInterrupt()
+	if p.config.drainIdleTimeout > 0 {
+		defer p.trackActivity(&connActivity{}, func() {
+			_ = inboundConn.SetReadDeadline(time.Unix(1, 0))
+		})()
+	}
+
+	br := bufio.NewReader(reader)
+	_, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	return &peekedConn{halfCloser: reader, reader: br}, nil
+}
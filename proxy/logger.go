@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// logSuppressedInterval is the interval at which the number of messages
+	// suppressed in excess of the log rate is logged.
+	logSuppressedInterval = 10 * time.Second
+)
+
+// logLevel is the severity of a log message.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// String returns the name of this log level.
+func (l logLevel) String() string {
+	switch l {
+	case levelDebug:
+		return "debug"
+	case levelInfo:
+		return "info"
+	case levelWarn:
+		return "warn"
+	case levelError:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+}
+
+// parseLogLevel parses the passed name into a log level.
+// Returns an error if the name is not a known log level.
+func parseLogLevel(name string) (logLevel, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return levelDebug, nil
+	case "info":
+		return levelInfo, nil
+	case "warn":
+		return levelWarn, nil
+	case "error":
+		return levelError, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %q: must be one of debug, info, warn, error", name)
+	}
+}
+
+// logger is a leveled logger which writes messages at or above its level
+// using the standard logger. Messages are tagged with the name of the proxy, if set.
+// If a rate limit is set, messages in excess of it are suppressed and counted.
+type logger struct {
+	suppressed int64
+	level      logLevel
+	name       string
+	limit      *tokenBucket
+}
+
+// newLogger returns a new logger that writes messages at or above the passed level.
+func newLogger(level logLevel) *logger {
+	return &logger{
+		level: level,
+	}
+}
+
+// enabled returns true if messages at the passed level will be written.
+func (l *logger) enabled(level logLevel) bool {
+	return level >= l.level
+}
+
+// logf writes the formatted message if the passed level is enabled.
+func (l *logger) logf(level logLevel, format string, v ...interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+
+	l.write(level, fmt.Sprintf(format, v...))
+}
+
+// write writes the passed message at the passed level, tagged with the name of the proxy,
+// unless it exceeds the rate limit.
+func (l *logger) write(level logLevel, message string) {
+	if l.limit != nil && !l.limit.allow() {
+		atomic.AddInt64(&l.suppressed, 1)
+		return
+	}
+
+	l.print(level, message)
+}
+
+// logSuppressed writes the number of messages suppressed since it was last called, if any.
+// It is written regardless of the rate limit, which would otherwise suppress it too.
+func (l *logger) logSuppressed() {
+	n := atomic.SwapInt64(&l.suppressed, 0)
+	if n > 0 {
+		l.print(levelWarn, fmt.Sprintf("suppressed %d log lines in excess of the log rate", n))
+	}
+}
+
+// print writes the passed message at the passed level, tagged with the name of the proxy.
+func (l *logger) print(level logLevel, message string) {
+	if l.name != "" {
+		log.Printf("[%s] [%s] %s", strings.ToUpper(level.String()), l.name, message)
+		return
+	}
+
+	log.Printf("[%s] %s", strings.ToUpper(level.String()), message)
+}
+
+// reportSuppressedLogs logs the number of log lines suppressed in excess of the
+// log rate at a fixed interval until the proxy is stopped.
+func (p *proxy) reportSuppressedLogs() {
+	ticker := time.NewTicker(logSuppressedInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.quitCh:
+			return
+		case <-ticker.C:
+			p.logger.logSuppressed()
+		}
+	}
+}
+
+// debugf writes a formatted message at the debug level.
+func (l *logger) debugf(format string, v ...interface{}) {
+	l.logf(levelDebug, format, v...)
+}
+
+// infof writes a formatted message at the info level.
+func (l *logger) infof(format string, v ...interface{}) {
+	l.logf(levelInfo, format, v...)
+}
+
+// warnf writes a formatted message at the warn level.
+func (l *logger) warnf(format string, v ...interface{}) {
+	l.logf(levelWarn, format, v...)
+}
+
+// errorf writes a formatted message at the error level.
+// Error messages are written regardless of the configured level.
+func (l *logger) errorf(format string, v ...interface{}) {
+	l.write(levelError, fmt.Sprintf(format, v...))
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+var (
+	errLoopDetected = errors.New("routing loop detected: target connects back to the proxy")
+)
+
+// loopDetector detects routing loops where an outbound connection dialed by the proxy
+// is accepted as an inbound connection by the same proxy. The local address of every
+// active outbound connection is compared with the remote address of every active
+// inbound connection, so loops are detected without modifying the proxied bytes.
+// Only loops that stay on the same host are detected, since any address translation
+// along a loop through other hosts changes the remote address of the inbound connection.
+// It is safe for concurrent use.
+type loopDetector struct {
+	mu       sync.Mutex
+	inbound  map[string]struct{}
+	outbound map[string]struct{}
+}
+
+// newLoopDetector returns a new loopDetector.
+func newLoopDetector() *loopDetector {
+	return &loopDetector{
+		inbound:  make(map[string]struct{}),
+		outbound: make(map[string]struct{}),
+	}
+}
+
+// addInbound records the remote address of an inbound connection.
+// Returns true if the address belongs to an outbound connection of the proxy,
+// in which case the address is not recorded.
+func (d *loopDetector) addInbound(remoteAddr net.Addr) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	addr := remoteAddr.String()
+	if _, ok := d.outbound[addr]; ok {
+		return true
+	}
+
+	d.inbound[addr] = struct{}{}
+	return false
+}
+
+// removeInbound removes the remote address of an inbound connection.
+func (d *loopDetector) removeInbound(remoteAddr net.Addr) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.inbound, remoteAddr.String())
+}
+
+// addOutbound records the local address of an outbound connection.
+// Returns true if the address belongs to an inbound connection of the proxy,
+// in which case the address is not recorded.
+func (d *loopDetector) addOutbound(localAddr net.Addr) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	addr := localAddr.String()
+	if _, ok := d.inbound[addr]; ok {
+		return true
+	}
+
+	d.outbound[addr] = struct{}{}
+	return false
+}
+
+// removeOutbound removes the local address of an outbound connection.
+func (d *loopDetector) removeOutbound(localAddr net.Addr) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.outbound, localAddr.String())
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// minRateWindow is the sliding window over which the rate of a client is measured.
+	minRateWindow = 10 * time.Second
+
+	// minRateTick is the interval at which the rate of a client is sampled.
+	minRateTick = time.Second
+)
+
+// rateConn is a connection that counts the bytes read from it.
+type rateConn struct {
+	halfCloser
+	bytes int64
+}
+
+// Read reads bytes from the connection and counts them.
+func (c *rateConn) Read(b []byte) (int, error) {
+	n, err := c.halfCloser.Read(b)
+	atomic.AddInt64(&c.bytes, int64(n))
+	return n, err
+}
+
+// enforceMinRate calls the passed close function if bytes are read from the passed
+// connection slower than the configured minimum rate, measured over a sliding window.
+// Clients are only measured once the configured grace period has passed. Windows
+// in which no bytes were read at all are considered idle rather than slow, so that
+// legitimately idle connections are not closed. Returns once the passed stop
+// channel is closed or the close function has been called.
+func (p *proxy) enforceMinRate(conn *rateConn, closeFn func(), stopCh <-chan struct{}) {
+	ticker := time.NewTicker(minRateTick)
+	defer ticker.Stop()
+
+	// samples holds the byte count at each tick of the last window, oldest first
+	windowTicks := int(minRateWindow / minRateTick)
+	samples := make([]int64, 0, windowTicks+1)
+	start := time.Now()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		samples = append(samples, atomic.LoadInt64(&conn.bytes))
+		if len(samples) > windowTicks+1 {
+			samples = samples[1:]
+		}
+		if time.Since(start) < p.config.minRateGrace || len(samples) <= windowTicks {
+			continue
+		}
+
+		read := samples[len(samples)-1] - samples[0]
+		rate := float64(read) / minRateWindow.Seconds()
+		if read > 0 && rate < float64(p.config.minRate) {
+			slowClientClosedCounter.WithLabelValues(id).Inc()
+			closeFn()
+			return
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+const (
+	// modeProxy forwards connections to the targets.
+	modeProxy = "proxy"
+
+	// modeEcho echoes the bytes of connections back to the client instead of forwarding them.
+	modeEcho = "echo"
+
+	// modeDiscard discards the bytes of connections instead of forwarding them.
+	modeDiscard = "discard"
+)
+
+// handleLocalConnection acts as the backend of the passed inbound connection
+// itself, echoing or discarding its bytes depending on the configured mode,
+// and updates the same metrics as proxied connections.
+func (p *proxy) handleLocalConnection(inboundConn net.Conn, errorCh chan<- error) {
+	sampled := p.sampleConnection()
+	if sampled {
+		p.logger.debugf("connection started: client=%v mode=%s", inboundConn.RemoteAddr().String(), p.config.mode)
+	}
+	start := time.Now()
+
+	stopInterrupt := p.stopOnDone(p.ctx, inboundConn)
+	defer stopInterrupt()
+
+	var writer io.Writer = inboundConn
+	if p.config.mode == modeDiscard {
+		writer = ioutil.Discard
+	}
+	bytesRead, err := copyContext(p.ctx, writer, inboundConn)
+	closeReason := copyCloseReason(err, clientSide, clientSide)
+	partial := err != nil
+	if partial {
+		p.logger.warnf("error copying bytes: %v", err)
+		partialCopyCounter.WithLabelValues(id).Inc()
+	}
+
+	// Bytes are both received and sent back when echoing
+	bytesCopied := bytesRead
+	if p.config.mode == modeEcho {
+		bytesCopied *= 2
+	}
+
+	elapsed := time.Now().Sub(start)
+	if sampled || partial {
+		p.logger.infof("connection ended: client=%v mode=%s duration=%v bytes_copied=%d reason=%s partial=%t",
+			inboundConn.RemoteAddr().String(),
+			p.config.mode,
+			elapsed.String(),
+			bytesCopied,
+			closeReason,
+			partial)
+	}
+
+	// Connection complete, so update metrics and close the inbound connection
+	connCloseReasonCounter.WithLabelValues(id, closeReason).Inc()
+	inboundBytesCounter.WithLabelValues(id).Add(float64(bytesCopied))
+	p.statsd.count("inbound_bytes_count", bytesCopied)
+	if elapsed > 0 {
+		throughput := float64(bytesCopied) / elapsed.Seconds()
+		connThroughputHistogram.WithLabelValues(id).Observe(throughput)
+		copyThroughputGauge.WithLabelValues(id).Set(copyThroughput.add(throughput))
+	}
+	p.settleInbound(inboundConn, bytesRead > 0)
+	err = p.closeInbound(inboundConn)
+	if err != nil {
+		errorCh <- err
+	}
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// netnsSupported is true if network namespaces are supported on this platform.
+const netnsSupported = true
+
+// inNetns calls the passed function on an OS thread switched into the network
+// namespace at the passed path, e.g. /var/run/netns/<name> or /proc/<pid>/ns/net.
+// Sockets created by the function stay in that namespace after it returns.
+func inNetns(path string, fn func() error) error {
+	ns, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to open network namespace: %w", err)
+	}
+	defer ns.Close()
+
+	// Namespaces are per thread, so keep the goroutine on this thread while switched
+	runtime.LockOSThread()
+	current, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", syscall.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("unable to open current network namespace: %w", err)
+	}
+	defer current.Close()
+
+	err = setns(ns.Fd())
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("unable to enter network namespace %s: %w", path, err)
+	}
+
+	fnErr := fn()
+
+	// A thread that cannot be switched back stays locked, so that it exits with
+	// the goroutine instead of running other goroutines in the wrong namespace
+	if setns(current.Fd()) == nil {
+		runtime.UnlockOSThread()
+	}
+
+	return fnErr
+}
+
+// setns switches the calling thread into the network namespace of the passed file descriptor.
+func setns(fd uintptr) error {
+	_, _, errno := syscall.RawSyscall(sysSetns, fd, syscall.CLONE_NEWNET, 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
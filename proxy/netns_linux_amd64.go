@@ -0,0 +1,5 @@
+package proxy
+
+// sysSetns is the number of the setns system call, which the syscall package
+// does not define on this architecture.
+const sysSetns = 308
@@ -0,0 +1,11 @@
+//go:build linux && !amd64 && !386
+// +build linux,!amd64,!386
+
+package proxy
+
+import (
+	"syscall"
+)
+
+// sysSetns is the number of the setns system call.
+const sysSetns = syscall.SYS_SETNS
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"errors"
+)
+
+// netnsSupported is true if network namespaces are supported on this platform.
+const netnsSupported = false
+
+// inNetns returns an error, since network namespaces are only supported on Linux.
+func inNetns(path string, fn func() error) error {
+	return errors.New("network namespaces are only supported on Linux")
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+const (
+	// originalDstSupported is true if reading the original destination of
+	// redirected connections is supported on this platform.
+	originalDstSupported = true
+
+	// soOriginalDst is the SO_ORIGINAL_DST socket option of netfilter, which returns
+	// the destination of a connection before it was redirected by iptables.
+	soOriginalDst = 80
+)
+
+// originalDst returns the address that the passed connection was sent to before it was
+// redirected to the proxy by an iptables REDIRECT or DNAT rule. Only IPv4 is supported.
+func originalDst(conn *net.TCPConn) (string, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	// The returned sockaddr_in fits in the buffer of an IPv6 multicast request
+	var mreq *syscall.IPv6Mreq
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+	})
+	if err != nil {
+		return "", err
+	}
+	if sockErr != nil {
+		return "", fmt.Errorf("getsockopt SO_ORIGINAL_DST: %w", sockErr)
+	}
+
+	addr := mreq.Multiaddr
+	ip := net.IPv4(addr[4], addr[5], addr[6], addr[7])
+	port := int(addr[2])<<8 | int(addr[3])
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+// originalDstSupported is true if reading the original destination of
+// redirected connections is supported on this platform.
+const originalDstSupported = false
+
+// originalDst returns an error, since reading the original destination is only supported on Linux.
+func originalDst(conn *net.TCPConn) (string, error) {
+	return "", errors.New("original destinations are only supported on Linux")
+}
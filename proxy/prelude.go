@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+const (
+	// rejectReasonPreludeFailed is the reject reason of connections whose
+	// target or client could not be sent its prelude.
+	rejectReasonPreludeFailed = "prelude_failed"
+
+	// maxPreludeBytes is the maximum size of each prelude, which is small enough to fit
+	// in the send buffer of a new socket so that writing it does not block.
+	maxPreludeBytes = 16 * 1024
+
+	// preludeWriteTimeout is the maximum duration of writing each prelude.
+	preludeWriteTimeout = time.Second
+)
+
+// setupPreludes reads the preludes written to targets and clients from the configured
+// files. Returns a nil prelude for each side that has no prelude file configured.
+func (p *proxy) setupPreludes() (backend, client []byte, err error) {
+	backend, err = readPrelude(p.config.backendPreludeFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read backend prelude: %w", err)
+	}
+	client, err = readPrelude(p.config.clientPreludeFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read client prelude: %w", err)
+	}
+	return backend, client, nil
+}
+
+// readPrelude reads a prelude from the file at the passed path.
+// Returns nil if the path is empty.
+func readPrelude(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	prelude, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(prelude) > maxPreludeBytes {
+		return nil, fmt.Errorf("invalid prelude of %d bytes: must be at most %d bytes", len(prelude), maxPreludeBytes)
+	}
+	return prelude, nil
+}
+
+// writePreludes writes the configured preludes to the passed connections, which have just
+// been established, before any bytes are copied between them. Returns an error if either
+// prelude could not be written, in which case the connection should be closed.
+func (p *proxy) writePreludes(inboundConn, outboundConn net.Conn) error {
+	if p.backendPrelude != nil {
+		err := writePrelude(outboundConn, p.backendPrelude)
+		if err != nil {
+			return fmt.Errorf("unable to write backend prelude: %w", err)
+		}
+	}
+	if p.clientPrelude != nil {
+		err := writePrelude(inboundConn, p.clientPrelude)
+		if err != nil {
+			return fmt.Errorf("unable to write client prelude: %w", err)
+		}
+	}
+	return nil
+}
+
+// writePrelude writes the passed prelude to the passed connection within the prelude write timeout.
+func writePrelude(conn net.Conn, prelude []byte) error {
+	err := conn.SetWriteDeadline(time.Now().Add(preludeWriteTimeout))
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(prelude)
+	if err != nil {
+		return err
+	}
+	return conn.SetWriteDeadline(time.Time{})
+}
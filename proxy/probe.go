@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+var (
+	errProbeFailed = errors.New("target failed the per-connection probe")
+)
+
+// probeTarget verifies that the target of the passed outbound connection is responsive
+// by sending the configured probe and reading the expected response within the probe
+// timeout. The response is consumed, so the client only sees bytes sent after it.
+func (p *proxy) probeTarget(conn net.Conn, target string) error {
+	err := conn.SetDeadline(time.Now().Add(p.config.probeTimeout))
+	if err != nil {
+		return err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	_, err = io.WriteString(conn, p.config.probe)
+	if err != nil {
+		return fmt.Errorf("%w: target=%s: error sending probe: %v", errProbeFailed, target, err)
+	}
+
+	response := make([]byte, len(p.config.probeResponse))
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		return fmt.Errorf("%w: target=%s: error reading response: %v", errProbeFailed, target, err)
+	}
+	if !bytes.Equal(response, []byte(p.config.probeResponse)) {
+		return fmt.Errorf("%w: target=%s: unexpected response %q", errProbeFailed, target, response)
+	}
+
+	return nil
+}
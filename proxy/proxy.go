@@ -3,14 +3,17 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"io"
-	"log"
 	"net"
 	"net/http"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -26,7 +29,14 @@ var (
 	outboundConnCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "outbound_connection_count",
-			Help: "The total number of outbound connections established",
+			Help: "The total number of outbound connections established, by target",
+		},
+		[]string{"id", "target"},
+	)
+	connsCompletedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "connections_completed_total",
+			Help: "The total number of proxied connections that ended having copied bytes in either direction",
 		},
 		[]string{"id"},
 	)
@@ -40,9 +50,9 @@ var (
 	outboundBytesCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "outbound_bytes_count",
-			Help: "The total number of bytes sent and received on outbound connections",
+			Help: "The total number of bytes sent and received on outbound connections, by target",
 		},
-		[]string{"id"},
+		[]string{"id", "target"},
 	)
 	activeInboundConnCount int64 = 0
 	activeInboundConnGauge       = prometheus.NewGaugeVec(
@@ -60,49 +70,522 @@ var (
 		},
 		[]string{"id"},
 	)
+	activeHalfOpenConnCount int64 = 0
+	activeHalfOpenConnGauge       = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "active_half_open_connections",
+			Help: "The number of currently active connections that one side has finished sending on while the other is still sending",
+		},
+		[]string{"id"},
+	)
+	activeDialingConnGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "active_dialing_connections",
+			Help: "The number of inbound connections currently waiting for their outbound connection to be dialed",
+		},
+		[]string{"id"},
+	)
+	maxActiveConnMu           sync.Mutex
+	maxActiveInboundConnCount int64 = 0
+	maxActiveInboundConnGauge       = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "max_active_inbound_connections",
+			Help: "The maximum number of concurrently active inbound connections observed since startup",
+		},
+		[]string{"id"},
+	)
+	maxActiveOutboundConnCount int64 = 0
+	maxActiveOutboundConnGauge       = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "max_active_outbound_connections",
+			Help: "The maximum number of concurrently active outbound connections observed since startup",
+		},
+		[]string{"id"},
+	)
+	noHealthyTargetsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "no_healthy_targets_count",
+			Help: "The total number of connections handled while no targets were healthy",
+		},
+		[]string{"id", "mode"},
+	)
+	connCloseReasonCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "connection_close_reason_total",
+			Help: "The total number of proxied connections closed, by reason",
+		},
+		[]string{"id", "reason"},
+	)
+	connsBySubnetCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "connections_by_subnet",
+			Help: "The total number of inbound connections by client /24 (IPv4) or /64 (IPv6) subnet",
+		},
+		[]string{"id", "subnet"},
+	)
+	httpRequestsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "The total number of HTTP requests observed on plaintext HTTP connections, by method and status",
+		},
+		[]string{"id", "method", "status"},
+	)
+	loopDetectedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "loop_detected_total",
+			Help: "The total number of connections closed because the target connects back to the proxy",
+		},
+		[]string{"id"},
+	)
+	copyBufferFullCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "copy_buffer_full_total",
+			Help: "The total number of times a stall buffer filled up and reading from a connection was paused",
+		},
+		[]string{"id"},
+	)
+	dnsResolutionFailuresCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dns_resolution_failures_total",
+			Help: "The total number of outbound connections that failed because the target could not be resolved",
+		},
+		[]string{"id"},
+	)
+	partialCopyCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "partial_copy_total",
+			Help: "The total number of copies between connections that ended on an error instead of EOF",
+		},
+		[]string{"id"},
+	)
+	connThroughputHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "connection_throughput_bytes_per_second",
+			Help:    "The average throughput of proxied connections over their lifetime, in bytes per second",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+		},
+		[]string{"id"},
+	)
+	dialAttemptsHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "dial_attempts",
+			Help:    "The number of targets dialed per connection until one succeeded or dialing gave up, including the fallback target",
+			Buckets: prometheus.LinearBuckets(1, 1, 5),
+		},
+		[]string{"id"},
+	)
+	halfCloseErrorsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "half_close_errors_total",
+			Help: "The total number of unexpected errors closing the read or write side of proxied connections",
+		},
+		[]string{"id"},
+	)
+	drainIdleClosedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "drain_idle_closed_total",
+			Help: "The total number of idle connections closed while draining during a graceful stop",
+		},
+		[]string{"id"},
+	)
+	writeTimeoutsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "write_timeouts_total",
+			Help: "The total number of connections closed because a write did not complete within the write timeout",
+		},
+		[]string{"id"},
+	)
+	targetDrainingGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "target_draining",
+			Help: "Whether a target is draining through the admin endpoint (1) or not (0), by target",
+		},
+		[]string{"id", "target"},
+	)
+	interarrivalHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "inbound_interarrival_seconds",
+			Help:    "The time between consecutive accepted inbound connections, in seconds",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		},
+		[]string{"id"},
+	)
+	bufferMemoryGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "buffer_memory_bytes",
+			Help: "The total size of the copy buffers currently allocated by active connections, in bytes",
+		},
+		[]string{"id"},
+	)
+	copyThroughput      movingAverage
+	copyThroughputGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "copy_throughput_bytes",
+			Help: "The moving average throughput of recently ended connections, in bytes per second",
+		},
+		[]string{"id"},
+	)
+	headerLimitExceededCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "header_limit_exceeded_total",
+			Help: "The total number of connections closed because a peeked header exceeded the maximum size",
+		},
+		[]string{"id"},
+	)
+	slowClientClosedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "slow_client_closed_total",
+			Help: "The total number of connections closed because the client sent bytes slower than the minimum rate",
+		},
+		[]string{"id"},
+	)
+	immediateCloseCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "immediate_close_total",
+			Help: "The total number of outbound connections closed by the target immediately after being accepted",
+		},
+		[]string{"id"},
+	)
+	unhealthyDrainCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "unhealthy_drain_closed_total",
+			Help: "The total number of connections closed because their target stayed unhealthy past the unhealthy drain grace period",
+		},
+		[]string{"id"},
+	)
+	globalRateLimitGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "global_rate_limit_bytes",
+			Help: "The maximum aggregate throughput of all connections, in bytes per second",
+		},
+		[]string{"id"},
+	)
+	globalThroughputGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "global_throughput_bytes",
+			Help: "The aggregate throughput of all connections over the last second, in bytes per second",
+		},
+		[]string{"id"},
+	)
+	asymmetricConnCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "asymmetric_connection_total",
+			Help: "The total number of connections whose bytes in one direction exceeded the asymmetry threshold times the other, by dominant direction",
+		},
+		[]string{"id", "direction"},
+	)
+	probeFailuresCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "probe_failures_total",
+			Help: "The total number of outbound connections whose target failed the per-connection probe",
+		},
+		[]string{"id"},
+	)
+	probeConnCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "probe_connection_total",
+			Help: "The total number of inbound connections that ended before the established threshold without exchanging bytes",
+		},
+		[]string{"id"},
+	)
+	faultsInjectedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "faults_injected_total",
+			Help: "The total number of faults injected into proxied connections, by fault",
+		},
+		[]string{"id", "fault"},
+	)
+	dialFailuresCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dial_failures_total",
+			Help: "The total number of failed dials of outbound connections, by reason",
+		},
+		[]string{"id", "reason"},
+	)
+	failoverCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "failover_total",
+			Help: "The total number of outbound connections that failed over to the fallback target",
+		},
+		[]string{"id"},
+	)
+	tarpitConnCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tarpit_connections_total",
+			Help: "The total number of rejected connections held open in the tarpit instead of being closed",
+		},
+		[]string{"id"},
+	)
+	activeTarpitGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "active_tarpit_connections",
+			Help: "The number of rejected connections currently held open in the tarpit",
+		},
+		[]string{"id"},
+	)
+	connsRejectedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "connections_rejected_total",
+			Help: "The total number of inbound connections closed without being proxied, by reason",
+		},
+		[]string{"id", "reason"},
+	)
+	secondsSinceLastConnGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "seconds_since_last_connection",
+			Help: "The number of seconds since an outbound connection was last established, or since startup if none has been",
+		},
+		[]string{"id"},
+	)
+	pausedGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "paused",
+			Help: "Whether the proxy is paused and closing new connections (1) or not (0)",
+		},
+		[]string{"id"},
+	)
 	outboundConnTimeout = 10 * time.Second
+	metricsBindBackoff  = 500 * time.Millisecond
+	drainPollInterval   = 100 * time.Millisecond
+	maxDrainLogInterval = 5 * time.Minute
+	lastConnInterval    = time.Second
+
+	// forcefulResetTimeout is how long a forceful stop waits for interrupted
+	// connections to be reset before the proxy stops.
+	forcefulResetTimeout = time.Second
+
+	// handlerWaitTimeout is how long a stop waits for the connections it interrupted to
+	// finish being handled, so that their audit records are written before the audit log
+	// is closed.
+	handlerWaitTimeout = 2 * time.Second
+
+	// maxTerminationGraceMargin is the most time left between the end of draining
+	// and the end of the termination grace period, for closing the remaining
+	// connections and exiting. The margin is a tenth of shorter grace periods.
+	maxTerminationGraceMargin = 5 * time.Second
 )
 
 const (
 	networkType = "tcp4"
+
+	// targetIPFamilyAuto dials targets over IPv4 or IPv6, as the dialer prefers when a name has both.
+	targetIPFamilyAuto = "auto"
+
+	// targetIPFamilyIPv4 dials targets over IPv4 only.
+	targetIPFamilyIPv4 = "ipv4"
+
+	// targetIPFamilyIPv6 dials targets over IPv6 only.
+	targetIPFamilyIPv6 = "ipv6"
+
+	// metricsBindAttempts is the number of times binding the metrics server is attempted.
+	metricsBindAttempts = 5
+
+	// closeReasonClientEOF is the close reason of connections that the client closed first.
+	closeReasonClientEOF = "client_eof"
+
+	// closeReasonBackendEOF is the close reason of connections that the target closed first.
+	closeReasonBackendEOF = "backend_eof"
+
+	// closeReasonClientReset is the close reason of connections reset by the client.
+	closeReasonClientReset = "client_reset"
+
+	// closeReasonBackendReset is the close reason of connections reset by the target.
+	closeReasonBackendReset = "backend_reset"
+
+	// closeReasonError is the close reason of connections that ended on any other error.
+	closeReasonError = "error"
+
+	// closeReasonSessionDeadline is the close reason of connections that
+	// exceeded the maximum session duration.
+	closeReasonSessionDeadline = "session_deadline"
+
+	// closeReasonSlowClient is the close reason of connections whose
+	// client sent bytes slower than the minimum rate.
+	closeReasonSlowClient = "slow_client"
+
+	// rejectReasonDraining is the reject reason of connections accepted while draining.
+	rejectReasonDraining = "draining"
+
+	// rejectReasonPaused is the reject reason of connections accepted while paused.
+	rejectReasonPaused = "paused"
+
+	// rejectReasonRateLimited is the reject reason of connections accepted in excess of the maximum accept rate.
+	rejectReasonRateLimited = "rate_limited"
+
+	// rejectReasonLoopDetected is the reject reason of connections that loop back to the proxy.
+	rejectReasonLoopDetected = "loop_detected"
+
+	// rejectReasonHeaderTooLarge is the reject reason of connections whose peeked header is too large.
+	rejectReasonHeaderTooLarge = "header_too_large"
+
+	// rejectReasonHeaderTimeout is the reject reason of connections whose peeked header
+	// does not end within the header timeout.
+	rejectReasonHeaderTimeout = "header_timeout"
+
+	// rejectReasonNoData is the reject reason of connections closed by the client
+	// before sending any bytes while waiting to dial lazily.
+	rejectReasonNoData = "no_data"
+
+	// rejectReasonNoHealthyTargets is the reject reason of connections rejected because no targets are healthy.
+	rejectReasonNoHealthyTargets = "no_healthy_targets"
+
+	// rejectReasonTargetsDraining is the reject reason of connections rejected because
+	// every target is draining through the admin endpoint.
+	rejectReasonTargetsDraining = "targets_draining"
+
+	// rejectReasonDialFailed is the reject reason of connections whose target could not be dialed.
+	rejectReasonDialFailed = "dial_failed"
+
+	// closeReasonReloadDrain is the close reason of connections to a target
+	// that was removed on reload and that outlived the reload drain window.
+	closeReasonReloadDrain = "reload_drain"
+
+	// closeReasonUnhealthyDrain is the close reason of connections to a target that
+	// became unhealthy and that outlived the unhealthy drain grace period.
+	closeReasonUnhealthyDrain = "unhealthy_drain"
+
+	// closeReasonTargetDrain is the close reason of connections to a target drained through
+	// the admin endpoint that outlived the grace period passed to the endpoint.
+	closeReasonTargetDrain = "target_drain"
+
+	// closeReasonHalfOpenLimit is the close reason of connections closed because
+	// they became half-open while the maximum number of half-open connections was reached.
+	closeReasonHalfOpenLimit = "half_open_limit"
+
+	// closeReasonFaultDrop is the close reason of connections dropped by fault injection.
+	closeReasonFaultDrop = "fault_drop"
+
+	// closeReasonWriteTimeout is the close reason of connections closed because a
+	// write to one of their sides did not complete within the write timeout.
+	closeReasonWriteTimeout = "write_timeout"
+
+	// closeReasonDrainIdle is the close reason of connections closed because they
+	// were idle for longer than the drain idle timeout during a graceful stop.
+	closeReasonDrainIdle = "drain_idle"
 )
 
-func init() {
-	prometheus.MustRegister(inboundConnCounter)
-	prometheus.MustRegister(outboundConnCounter)
-	prometheus.MustRegister(inboundBytesCounter)
-	prometheus.MustRegister(outboundBytesCounter)
-	prometheus.MustRegister(activeInboundConnGauge)
-	prometheus.MustRegister(activeOutboundConnGauge)
+// proxyCollectors are the prometheus collectors registered by the proxy.
+var proxyCollectors = []prometheus.Collector{
+	inboundConnCounter,
+	interarrivalHistogram,
+	probeConnCounter,
+	outboundConnCounter,
+	connsCompletedCounter,
+	inboundBytesCounter,
+	outboundBytesCounter,
+	activeInboundConnGauge,
+	activeOutboundConnGauge,
+	activeDialingConnGauge,
+	activeHalfOpenConnGauge,
+	maxActiveInboundConnGauge,
+	maxActiveOutboundConnGauge,
+	noHealthyTargetsCounter,
+	connCloseReasonCounter,
+	connsBySubnetCounter,
+	httpRequestsCounter,
+	loopDetectedCounter,
+	copyBufferFullCounter,
+	dnsResolutionFailuresCounter,
+	partialCopyCounter,
+	halfCloseErrorsCounter,
+	connThroughputHistogram,
+	dialAttemptsHistogram,
+	copyThroughputGauge,
+	bufferMemoryGauge,
+	headerLimitExceededCounter,
+	slowClientClosedCounter,
+	writeTimeoutsCounter,
+	drainIdleClosedCounter,
+	immediateCloseCounter,
+	probeFailuresCounter,
+	dialFailuresCounter,
+	failoverCounter,
+	unhealthyDrainCounter,
+	faultsInjectedCounter,
+	asymmetricConnCounter,
+	globalRateLimitGauge,
+	globalThroughputGauge,
+	connsRejectedCounter,
+	tarpitConnCounter,
+	activeTarpitGauge,
+	secondsSinceLastConnGauge,
+	pausedGauge,
+	targetDrainingGauge,
 }
 
 // proxy is a TCP proxy which exposes telemetry metrics via prometheus instrumentation.
 type proxy struct {
-	config        config
-	metricsServer *http.Server
-	tcpListener   net.Listener
-	tcpDialer     *net.Dialer
-	doneCh        chan<- struct{}
+	connSeq        uint64
+	lastConn       int64
+	lastAccept     int64
+	tarpitted      int64
+	handling       int64
+	globalBytes    int64
+	draining       int32
+	paused         int32
+	config         config
+	metricsServer  *http.Server
+	registerer     prometheus.Registerer
+	collectors     []prometheus.Collector
+	tcpListener    net.Listener
+	tcpDialer      *net.Dialer
+	targets        *targetSet
+	subnets        *subnetLabels
+	loops          *loopDetector
+	acceptRate     *tokenBucket
+	globalRate     *tokenBucket
+	faults         *faultInjector
+	accessLog      *accessLog
+	conns          *targetConns
+	statsd         *statsdClient
+	audit          *auditLog
+	rejectResponse []byte
+	backendPrelude []byte
+	clientPrelude  []byte
+	establishing   sync.Map
+	activity       sync.Map
+	dials          *dialOutcomes
+	logger         *logger
+	ctx            context.Context
+	cancel         context.CancelFunc
+	readyCh        chan struct{}
+	quitCh         chan struct{}
+	doneCh         chan<- struct{}
 }
 
 // NewProxy returns a new proxy having the passed configuration.
 // The passed done channel will be closed when the proxy has completed shutting down.
 func NewProxy(config config, doneCh chan<- struct{}) *proxy {
+	ctx, cancel := context.WithCancel(context.Background())
+	logger := newLogger(levelInfo)
+	logger.name = config.name
 	return &proxy{
-		config: config,
-		doneCh: doneCh,
+		config:  config,
+		logger:  logger,
+		ctx:     ctx,
+		cancel:  cancel,
+		readyCh: make(chan struct{}),
+		quitCh:  make(chan struct{}),
+		doneCh:  doneCh,
 	}
 }
 
 // Start start the proxy by listening on the configured address for TCP connections.
 func (p *proxy) Start() error {
-	log.Println("starting the TCP proxy")
+	p.logger.infof("starting the TCP proxy: id=%s", id)
 
 	// Parse the configuration
 	err := p.config.parse()
 	if err != nil {
 		return err
 	}
+	p.logger.level = p.config.logLevel
+	if p.config.logRate > 0 {
+		p.logger.limit = newTokenBucket(float64(p.config.logRate))
+	}
+	if p.config.logConfig {
+		p.logConfig()
+	}
 
 	// Set up the proxy
 	err = p.setup()
@@ -110,12 +593,40 @@ func (p *proxy) Start() error {
 		return err
 	}
 
-	errorCh := make(chan error, 1)
+	// Buffer an error per accept worker, since each fails once the listener is closed
+	errorCh := make(chan error, p.config.acceptWorkers)
 
 	// Start the prometheus metrics server
-	go p.startMetricsServer(errorCh)
+	if p.metricsServer != nil {
+		go p.startMetricsServer(errorCh)
+	}
+
+	// Start tracking the time since the last connection
+	go p.trackLastConnection()
+
+	// Start logging the number of log lines suppressed by the log rate
+	if p.config.logRate > 0 {
+		go p.reportSuppressedLogs()
+	}
+
+	// Start watching the targets file for changes
+	if p.config.targetsFile != "" {
+		go p.watchTargetsFile()
+	}
+
+	// Announce the address that the TCP listener is bound to, which
+	// differs from the configured address when listening on port 0
+	if p.config.announceFile != "" {
+		err = p.writeAnnounceFile()
+		if err != nil {
+			return fmt.Errorf("failed to write announce file: %w", err)
+		}
+	}
 
-	// Start accepting connections on the TCP listener
+	// Report readiness now that the proxy is fully set up, then start accepting
+	// connections on the TCP listener. Connections completed by the kernel
+	// before then wait in the listen backlog.
+	close(p.readyCh)
 	go p.startTCPListener(errorCh)
 
 	// Block until an error is received
@@ -125,9 +636,46 @@ func (p *proxy) Start() error {
 
 // setup sets up the proxy in order to begin accepting connections.
 func (p *proxy) setup() error {
-	// Set up the metrics server, listener, and dialer
-	metricsServer := p.setupMetricsServer()
-	tcpDialer := p.setupTCPDialer()
+	// Register the prometheus collectors
+	registerer, collectors, err := p.registerMetrics()
+	if err != nil {
+		return err
+	}
+	pausedGauge.WithLabelValues(id).Set(0)
+	atomic.StoreInt64(&p.lastConn, time.Now().UnixNano())
+
+	// Set up the metrics server, StatsD client, targets, listener, and dialer
+	var metricsServer *http.Server
+	if p.config.metricsAddress != "" {
+		metricsServer, err = p.setupMetricsServer()
+		if err != nil {
+			return err
+		}
+	}
+	statsd, err := p.setupStatsdClient()
+	if err != nil {
+		return err
+	}
+	audit, err := p.setupAuditLog()
+	if err != nil {
+		return err
+	}
+	rejectResponse, err := p.setupRejectResponse()
+	if err != nil {
+		return err
+	}
+	backendPrelude, clientPrelude, err := p.setupPreludes()
+	if err != nil {
+		return err
+	}
+	targets, err := p.setupTargets()
+	if err != nil {
+		return err
+	}
+	tcpDialer, err := p.setupTCPDialer()
+	if err != nil {
+		return err
+	}
 	tcpListener, err := p.setupTCPListener()
 	if err != nil {
 		return err
@@ -135,6 +683,43 @@ func (p *proxy) setup() error {
 
 	// Assign them to the proxy
 	p.metricsServer = metricsServer
+	p.registerer = registerer
+	p.collectors = collectors
+	p.statsd = statsd
+	p.audit = audit
+	p.rejectResponse = rejectResponse
+	p.backendPrelude = backendPrelude
+	p.clientPrelude = clientPrelude
+	p.targets = targets
+	p.subnets = newSubnetLabels(p.config.maxSubnetLabels)
+	p.dials = &dialOutcomes{}
+	if p.config.loopDetection {
+		p.loops = newLoopDetector()
+	}
+	if p.config.accessLog != "" {
+		p.accessLog = newAccessLog(p.config.accessLog)
+	}
+	if p.config.faultDropRate > 0 || p.config.faultDelay > 0 {
+		seed := p.config.faultSeed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		p.faults = newFaultInjector(p.config.faultDropRate, p.config.faultDelay, seed)
+		p.logger.warnf("injecting faults: drop_rate=%v delay=%v seed=%d",
+			p.config.faultDropRate, p.config.faultDelay, seed)
+	}
+	if p.config.globalRateLimit > 0 {
+		p.globalRate = newTokenBucket(float64(p.config.globalRateLimit))
+		go p.trackGlobalThroughput()
+	}
+	if p.config.maxAcceptRate > 0 {
+		p.acceptRate = newTokenBucket(p.config.maxAcceptRate)
+	}
+	if p.config.reloadDrain > 0 || p.config.unhealthyDrain > 0 || p.config.metricsAddress != "" {
+		// Connections are tracked to be drained on reload, when their target becomes
+		// unhealthy, or when their target is drained through the admin endpoint
+		p.conns = newTargetConns()
+	}
 	p.tcpDialer = &tcpDialer
 	p.tcpListener = tcpListener
 
@@ -143,86 +728,386 @@ func (p *proxy) setup() error {
 
 // StopForceful stops the proxy forcefully by severing all TCP connections.
 func (p *proxy) StopForceful() {
-	log.Println("forcefully stopping the TCP proxy")
+	p.logger.infof("forcefully stopping the TCP proxy")
 
 	err := p.stopMetricsServerForceful()
 	if err != nil {
-		log.Printf("error occurred shutting down prometheus metrics server: %v", err)
+		p.logger.errorf("error occurred shutting down prometheus metrics server: %v", err)
 	}
 
 	err = p.stopTCPListenerForceful()
 	if err != nil {
-		log.Printf("error occurred shutting down TCP listener: %v", err)
+		p.logger.errorf("error occurred shutting down TCP listener: %v", err)
+	}
+
+	// Interrupt connections that are still copying
+	p.cancel()
+	p.awaitReset()
+	p.awaitHandlers()
+
+	err = p.statsd.close()
+	if err != nil {
+		p.logger.errorf("error occurred closing StatsD client: %v", err)
+	}
+
+	err = p.audit.close()
+	if err != nil {
+		p.logger.errorf("error occurred closing audit log: %v", err)
 	}
 
+	p.removeAnnounceFile()
+	p.unregisterMetrics()
+	p.logger.logSuppressed()
+	close(p.quitCh)
 	close(p.doneCh)
 }
 
 // StopGraceful stops the proxy gracefully by bleeding off all TCP connections.
 // The proxy will continue to copy bytes for existing TCP connections.
 // The proxy will not accept any new TCP connections.
+// The metrics server is shut down last, so that draining can be observed through it.
 func (p *proxy) StopGraceful() {
-	log.Println("gracefully stopping the TCP proxy")
+	p.logger.infof("gracefully stopping the TCP proxy")
+	p.startDraining()
+
+	err := p.stopTCPListenerGraceful()
+	if err != nil {
+		p.logger.errorf("error occurred gracefully shutting down TCP listener: %v", err)
+	}
+
+	err = p.stopMetricsServerGraceful()
+	if err != nil {
+		p.logger.errorf("error occurred gracefully shutting down prometheus metrics server: %v", err)
+	}
 
-	err := p.stopMetricsServerGraceful()
+	// Connections interrupted when draining is cut short may still be recording their end
+	p.awaitHandlers()
+
+	err = p.statsd.close()
 	if err != nil {
-		log.Printf("error occurred gracefully shutting down prometheus metrics server: %v", err)
+		p.logger.errorf("error occurred closing StatsD client: %v", err)
 	}
 
-	err = p.stopTCPListenerGraceful()
+	err = p.audit.close()
 	if err != nil {
-		log.Printf("error occurred gracefully shutting down TCP listener: %v", err)
+		p.logger.errorf("error occurred closing audit log: %v", err)
 	}
 
+	p.removeAnnounceFile()
+	p.unregisterMetrics()
+	p.logger.logSuppressed()
+	close(p.quitCh)
 	close(p.doneCh)
 }
 
-// setupMetricsServer sets up the prometheus metrics server.
-func (p *proxy) setupMetricsServer() *http.Server {
-	srv := http.Server{
-		Addr: p.config.metricsAddress,
+// registerMetrics registers the prometheus collectors of the proxy with a registerer
+// that wraps the default registerer, adding the configured constant labels to each metric.
+// Returns the wrapped registerer and the registered collectors.
+func (p *proxy) registerMetrics() (prometheus.Registerer, []prometheus.Collector, error) {
+	registerer := prometheus.WrapRegistererWith(p.config.constLabels, prometheus.DefaultRegisterer)
+	collectors := append(proxyCollectors[:len(proxyCollectors):len(proxyCollectors)], p.targetCollectors()...)
+	collectors = append(collectors, p.dialOutcomeCollectors()...)
+	for _, collector := range collectors {
+		err := registerer.Register(collector)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
-	srv.Handler = promhttp.Handler()
-	return &srv
-}
 
-// startMetricsServer starts the prometheus metrics server.
-func (p *proxy) startMetricsServer(errorCh chan<- error) {
-	log.Println("started: prometheus metrics server")
+	return registerer, collectors, nil
+}
 
-	err := p.metricsServer.ListenAndServe()
-	if err != http.ErrServerClosed {
-		// Error starting or closing listener
-		errorCh <- err
+// unregisterMetrics unregisters the prometheus collectors of the proxy, so that
+// a new proxy can be started in the same process once this one has stopped.
+func (p *proxy) unregisterMetrics() {
+	for _, collector := range p.collectors {
+		p.registerer.Unregister(collector)
 	}
 }
 
-// stopMetricsServerForceful forcefully stops the prometheus metrics server.
-func (p *proxy) stopMetricsServerForceful() error {
-	return p.metricsServer.Close()
-}
+// setupStatsdClient sets up the StatsD client if a StatsD address is configured.
+// Returns a nil client otherwise.
+func (p *proxy) setupStatsdClient() (*statsdClient, error) {
+	if p.config.statsdAddress == "" {
+		return nil, nil
+	}
 
-// stopMetricsServerGraceful gracefully stops the prometheus metrics server.
-func (p *proxy) stopMetricsServerGraceful() error {
-	return p.metricsServer.Shutdown(context.Background())
+	return newStatsdClient(p.config.statsdAddress)
 }
 
-// setupTCPDialer sets up the outbound TCP dialer.
-func (p *proxy) setupTCPDialer() net.Dialer {
-	return net.Dialer{
-		Timeout: time.Minute,
+// setupAuditLog opens the audit log if an audit log file is configured.
+// Returns a nil audit log otherwise.
+func (p *proxy) setupAuditLog() (*auditLog, error) {
+	if p.config.auditLog == "" {
+		return nil, nil
 	}
+
+	audit, err := newAuditLog(p.config.auditLog)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open audit log: %w", err)
+	}
+	return audit, nil
 }
 
-// setupTCPListener sets up the incoming TCP listener.
+// setupMetricsServer sets up the prometheus metrics server, which also serves the admin endpoints.
+// Returns an error if the configured TLS certificate cannot be loaded.
+func (p *proxy) setupMetricsServer() (*http.Server, error) {
+	// Warn unless exposing the metrics and admin endpoints beyond this host is intended
+	if !p.config.metricsAllowExternal && !isLoopbackHost(p.config.metricsHost) {
+		p.logger.warnf("metrics server is reachable from other hosts: address=%s: "+
+			"its admin endpoints can pause and drain the proxy, so bind it to a loopback address "+
+			"or explicitly allow external access", p.config.metricsAddress)
+	}
+
+	srv := http.Server{
+		Addr: p.config.metricsAddress,
+	}
+	srv.Handler = p.adminHandler()
+
+	// Serve over HTTPS if a certificate is configured
+	if p.config.metricsTLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(p.config.metricsTLSCert, p.config.metricsTLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load metrics TLS certificate: %w", err)
+		}
+		srv.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+
+	return &srv, nil
+}
+
+// startMetricsServer starts the prometheus metrics server.
+func (p *proxy) startMetricsServer(errorCh chan<- error) {
+	listener, err := p.bindMetricsServer()
+	if err != nil {
+		// Error binding listener after exhausting retries
+		errorCh <- bindError(err, "metrics", p.config.metricsAddress)
+		return
+	}
+	if listener == nil {
+		// Proxy stopped while binding
+		return
+	}
+
+	if p.metricsServer.TLSConfig != nil {
+		// The certificate was loaded into the TLS config during setup
+		p.logger.infof("started: prometheus metrics server (TLS)")
+		err = p.metricsServer.ServeTLS(listener, "", "")
+	} else {
+		p.logger.infof("started: prometheus metrics server")
+		err = p.metricsServer.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
+		// Error serving or closing listener
+		errorCh <- err
+	}
+}
+
+// bindMetricsServer binds the listener of the prometheus metrics server.
+// Binding is retried with exponential backoff in case the address is transiently
+// unavailable. Returns a nil listener if the proxy is stopped while retrying.
+func (p *proxy) bindMetricsServer() (net.Listener, error) {
+	backoff := metricsBindBackoff
+	for attempt := 1; ; attempt++ {
+		listener, err := net.Listen("tcp", p.config.metricsAddress)
+		if err == nil {
+			return listener, nil
+		}
+		if attempt == metricsBindAttempts {
+			return nil, err
+		}
+
+		p.logger.warnf("failed to bind prometheus metrics server (attempt %d of %d), retrying in %v: %v",
+			attempt, metricsBindAttempts, backoff, err)
+
+		select {
+		case <-p.quitCh:
+			return nil, nil
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// stopMetricsServerForceful forcefully stops the prometheus metrics server.
+func (p *proxy) stopMetricsServerForceful() error {
+	if p.metricsServer == nil {
+		return nil
+	}
+
+	return p.metricsServer.Close()
+}
+
+// stopMetricsServerGraceful gracefully stops the prometheus metrics server.
+func (p *proxy) stopMetricsServerGraceful() error {
+	if p.metricsServer == nil {
+		return nil
+	}
+
+	return p.metricsServer.Shutdown(context.Background())
+}
+
+// setupTCPDialer sets up the outbound TCP dialer.
+// Returns an error if the configured bind address is not a local address,
+// or if a TTL is configured on a platform that does not support setting it.
+func (p *proxy) setupTCPDialer() (net.Dialer, error) {
+	dialer := net.Dialer{
+		Timeout: p.config.dialTimeout,
+	}
+
+	// Bind outbound connections to the configured local address
+	if p.config.bindIP != nil {
+		local, err := isLocalIP(p.config.bindIP)
+		if err != nil {
+			return dialer, err
+		}
+		if !local {
+			return dialer, fmt.Errorf("bind address %s is not an address of a local interface", p.config.bindIP)
+		}
+
+		dialer.LocalAddr = &net.TCPAddr{IP: p.config.bindIP}
+	}
+
+	// Set the TTL of outbound packets
+	var controls []controlFunc
+	if p.config.ttl > 0 {
+		control, err := setTTL(p.config.ttl)
+		if err != nil {
+			return dialer, err
+		}
+		controls = append(controls, control)
+	}
+
+	// Enable TCP Fast Open on outbound sockets
+	if p.config.tcpFastOpen && tcpFastOpenSupported {
+		controls = append(controls, tcpFastOpenDialControl)
+	}
+
+	// Bound how long data sent to targets may remain unacknowledged
+	if p.config.userTimeout > 0 && userTimeoutSupported {
+		controls = append(controls, userTimeoutControl(p.config.userTimeout))
+	}
+	dialer.Control = chainControls(controls...)
+
+	// Resolve target names with the configured DNS server
+	if p.config.dnsServer != "" {
+		dialer.Resolver = newResolver(p.config.dnsServer, dialer.LocalAddr)
+	}
+
+	return dialer, nil
+}
+
+// newResolver returns a resolver that sends all queries to the passed DNS server
+// address, regardless of the resolvers configured for the host. Queries are sent
+// from the passed local address, if not nil.
+func newResolver(server string, localAddr net.Addr) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialer := net.Dialer{
+				Timeout: outboundConnTimeout,
+			}
+			if tcpAddr, ok := localAddr.(*net.TCPAddr); ok {
+				// Queries are sent over UDP or TCP, so bind the IP address of either
+				if network == "tcp" || network == "tcp4" || network == "tcp6" {
+					dialer.LocalAddr = &net.TCPAddr{IP: tcpAddr.IP}
+				} else {
+					dialer.LocalAddr = &net.UDPAddr{IP: tcpAddr.IP}
+				}
+			}
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// isLocalIP returns true if the passed IP address is assigned to a local interface.
+func isLocalIP(ip net.IP) (bool, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false, err
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// isLoopbackHost returns true if the passed host is a loopback IP address or localhost.
+// An empty host listens on all interfaces, so is not a loopback host.
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// setupTCPListener sets up the incoming TCP listener.
 func (p *proxy) setupTCPListener() (net.Listener, error) {
-	return net.Listen(networkType, p.config.listenAddress)
+	var listenConfig net.ListenConfig
+	var controls []controlFunc
+
+	// Enable TCP Fast Open on the listening socket
+	if p.config.tcpFastOpen {
+		if tcpFastOpenSupported {
+			controls = append(controls, tcpFastOpenListenControl)
+		} else {
+			p.logger.warnf("TCP Fast Open is not supported on this platform, using regular handshakes")
+		}
+	}
+
+	// Bound how long data sent to clients may remain unacknowledged
+	if p.config.userTimeout > 0 {
+		if userTimeoutSupported {
+			controls = append(controls, userTimeoutControl(p.config.userTimeout))
+		} else {
+			p.logger.warnf("TCP user timeouts are not supported on this platform, ignoring the user timeout")
+		}
+	}
+	listenConfig.Control = chainControls(controls...)
+
+	// Create the listening socket in the configured network namespace
+	var listener net.Listener
+	listen := func() error {
+		var err error
+		listener, err = listenConfig.Listen(context.Background(), networkType, p.config.listenAddress)
+		return err
+	}
+	var err error
+	if p.config.listenNetns != "" {
+		err = inNetns(p.config.listenNetns, listen)
+	} else {
+		err = listen()
+	}
+	if err != nil {
+		return nil, bindError(err, "listen", p.config.listenAddress)
+	}
+
+	return listener, nil
 }
 
 // startTCPListener starts the TCP listener so that it can accept new connections.
+// Connections are accepted by the configured number of accept workers.
 func (p *proxy) startTCPListener(errorCh chan<- error) {
-	log.Println("started: TCP connection listener")
+	p.logger.infof("started: TCP connection listener: address=%v", p.tcpListener.Addr())
 
+	for i := 1; i < p.config.acceptWorkers; i++ {
+		go p.acceptConnections(errorCh)
+	}
+	p.acceptConnections(errorCh)
+}
+
+// acceptConnections accepts connections on the TCP listener and handles each
+// in a new goroutine until accepting fails. It is safe to run concurrently.
+func (p *proxy) acceptConnections(errorCh chan<- error) {
 	for {
 		conn, err := p.tcpListener.Accept()
 		if err != nil {
@@ -231,10 +1116,48 @@ func (p *proxy) startTCPListener(errorCh chan<- error) {
 		}
 
 		// update inbound metrics
-		inboundConnCounter.WithLabelValues(id).Inc()
-		atomic.AddInt64(&activeInboundConnCount, 1)
+		p.observeInterarrival()
+		p.trackInbound(conn)
+		active := atomic.AddInt64(&activeInboundConnCount, 1)
 		activeInboundConnGauge.WithLabelValues(id).Inc()
+		updateMax(&maxActiveInboundConnCount, active, maxActiveInboundConnGauge)
+		p.statsd.gauge("active_inbound_connections", active)
+
+		// Close new connections in excess of the maximum accept rate
+		if p.acceptRate != nil && !p.acceptRate.allow() {
+			p.logger.debugf("refused connection: client=%v: accept rate exceeded", conn.RemoteAddr().String())
+			err := p.tarpitOrReject(conn, rejectReasonRateLimited)
+			if err != nil {
+				errorCh <- err
+				return
+			}
+			continue
+		}
+
+		// Close new connections immediately while paused
+		if p.IsPaused() {
+			p.logger.debugf("refused connection: client=%v: proxy is paused", conn.RemoteAddr().String())
+			err := p.rejectInbound(conn, rejectReasonPaused)
+			if err != nil {
+				errorCh <- err
+				return
+			}
+			continue
+		}
 
+		// Close new connections rejected by a connection filter
+		allowed, reason := p.filterConnection(conn)
+		if !allowed {
+			p.logger.debugf("refused connection: client=%v: rejected by filter: reason=%s", conn.RemoteAddr().String(), reason)
+			err := p.tarpitOrReject(conn, reason)
+			if err != nil {
+				errorCh <- err
+				return
+			}
+			continue
+		}
+
+		atomic.AddInt64(&p.handling, 1)
 		go p.handleTCPConnection(conn, errorCh)
 	}
 }
@@ -242,98 +1165,893 @@ func (p *proxy) startTCPListener(errorCh chan<- error) {
 // stopTCPListenerForceful stops the TCP listener forcefully
 // by immediately severing existing connections.
 func (p *proxy) stopTCPListenerForceful() error {
+	if p.tcpListener == nil {
+		return nil
+	}
+
 	return p.tcpListener.Close()
 }
 
 // stopTCPListenerGraceful stops the TCP listener gracefully by bleeding
 // all current connections and not accepting any new connections.
+// Drain progress is logged at the configured interval, which doubles after
+// each log up to a maximum so that long drains do not flood the logs.
 func (p *proxy) stopTCPListenerGraceful() error {
-	for activeInboundConnCount != 0 && activeOutboundConnCount != 0 {
-		log.Printf("draining %d connections", activeInboundConnCount+activeOutboundConnCount)
-		time.Sleep(time.Second * 5)
+	start := time.Now()
+	interval := p.config.drainLogInterval
+	nextLog := start
+	drained := false
+	deadline := p.drainDeadline(start)
+	for atomic.LoadInt64(&activeInboundConnCount) != 0 || atomic.LoadInt64(&activeOutboundConnCount) != 0 {
+		drained = true
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			p.logger.warnf("drain cut short by the termination grace period: closing %d connections: elapsed=%v",
+				atomic.LoadInt64(&activeInboundConnCount)+atomic.LoadInt64(&activeOutboundConnCount),
+				time.Since(start).Round(time.Millisecond))
+
+			// Interrupt connections that are still copying
+			p.cancel()
+			p.awaitReset()
+			return nil
+		}
+		if p.config.drainIdleTimeout > 0 {
+			closed := p.closeIdleConns()
+			if closed > 0 {
+				p.logger.infof("closed %d idle connections while draining: elapsed=%v",
+					closed, time.Since(start).Round(time.Millisecond))
+			}
+		}
+		if interval > 0 && !time.Now().Before(nextLog) {
+			p.logger.infof("draining %d connections: elapsed=%v",
+				atomic.LoadInt64(&activeInboundConnCount)+atomic.LoadInt64(&activeOutboundConnCount),
+				time.Since(start).Round(time.Second))
+
+			nextLog = time.Now().Add(interval)
+			interval *= 2
+			if interval > maxDrainLogInterval {
+				interval = maxDrainLogInterval
+			}
+		}
+		time.Sleep(drainPollInterval)
+	}
+
+	if drained {
+		p.logger.infof("drained connections: elapsed=%v", time.Since(start).Round(time.Millisecond))
 	}
 
 	return nil
 }
 
+// drainDeadline returns the time by which draining that started at the passed time
+// must end for the proxy to exit before the configured termination grace period
+// ends, or the zero time if no grace period is configured.
+func (p *proxy) drainDeadline(start time.Time) time.Time {
+	if p.config.terminationGrace == 0 {
+		return time.Time{}
+	}
+
+	margin := p.config.terminationGrace / 10
+	if margin > maxTerminationGraceMargin {
+		margin = maxTerminationGraceMargin
+	}
+	return start.Add(p.config.terminationGrace - margin)
+}
+
+// trackLastConnection updates the seconds since last connection gauge at a fixed
+// interval until the proxy is stopped.
+func (p *proxy) trackLastConnection() {
+	ticker := time.NewTicker(lastConnInterval)
+	defer ticker.Stop()
+
+	for {
+		last := time.Unix(0, atomic.LoadInt64(&p.lastConn))
+		secondsSinceLastConnGauge.WithLabelValues(id).Set(time.Since(last).Seconds())
+
+		select {
+		case <-p.quitCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// observeInterarrival observes the time since the previous inbound connection was
+// accepted. It is safe to call concurrently from multiple accept workers.
+func (p *proxy) observeInterarrival() {
+	now := time.Now().UnixNano()
+	last := atomic.SwapInt64(&p.lastAccept, now)
+	if last == 0 || now < last {
+		// The first connection has no previous connection, and concurrent
+		// accept workers may swap their accept times out of order
+		return
+	}
+	interarrivalHistogram.WithLabelValues(id).Observe(time.Duration(now - last).Seconds())
+}
+
+// closeInbound closes an inbound connection that will not be proxied
+// and decrements the active inbound connection gauge.
+func (p *proxy) closeInbound(inboundConn net.Conn) error {
+	p.settleInbound(inboundConn, false)
+	err := inboundConn.Close()
+	if err != nil {
+		return err
+	}
+
+	// Inbound connection has been closed, so decrement active inbound gauge
+	active := atomic.AddInt64(&activeInboundConnCount, -1)
+	activeInboundConnGauge.WithLabelValues(id).Dec()
+	p.statsd.gauge("active_inbound_connections", active)
+	return nil
+}
+
+// rejectInbound closes an inbound connection that will not be proxied for the passed
+// reason, and counts it in the rejected connections metric. The configured reject
+// response, if any, is written to the connection before it is closed.
+func (p *proxy) rejectInbound(inboundConn net.Conn, reason string) error {
+	connsRejectedCounter.WithLabelValues(id, reason).Inc()
+	if p.rejectResponse != nil {
+		p.writeRejectResponse(inboundConn)
+	}
+	return p.closeInbound(inboundConn)
+}
+
+// dialTarget dials an outbound connection to the next healthy target in the target set,
+// failing over to the fallback target if one is configured and dialing the targets fails.
+// The number of targets dialed is observed once dialing succeeds or gives up.
+// Returns the connection and the address of its target.
+func (p *proxy) dialTarget(ctx context.Context) (net.Conn, string, error) {
+	conn, target, attempts, err := p.dialTargets(ctx)
+	defer func() {
+		// Connections rejected without dialing any target are not observed
+		if attempts > 0 {
+			dialAttemptsHistogram.WithLabelValues(id).Observe(float64(attempts))
+		}
+	}()
+	if err == nil || p.config.fallbackTarget == "" {
+		return conn, target, err
+	}
+
+	failoverCounter.WithLabelValues(id).Inc()
+	p.logger.warnf("failing over to fallback target: fallback=%s: %v", p.config.fallbackTarget, err)
+	attempts++
+	conn, err = p.dial(ctx, p.config.fallbackTarget)
+	if err != nil {
+		countDialFailure(err)
+		return nil, "", err
+	}
+	if p.config.probe != "" {
+		err = p.probeTarget(conn, p.config.fallbackTarget)
+		if err != nil {
+			probeFailuresCounter.WithLabelValues(id).Inc()
+			_ = conn.Close()
+			return nil, "", err
+		}
+	}
+
+	return conn, p.config.fallbackTarget, nil
+}
+
+// dialTargets dials an outbound connection to the next healthy target in the target set.
+// Returns the connection, the address of its target, and the number of targets dialed.
+// Targets that fail the per-connection probe, and if enabled, targets that close the
+// connection immediately after accepting it, are retried with the next target,
+// until every target has been tried once.
+func (p *proxy) dialTargets(ctx context.Context) (net.Conn, string, int, error) {
+	attempts := 1
+	if p.config.immediateCloseRetry || p.config.probe != "" {
+		attempts = len(p.targets.list())
+	}
+
+	for attempt := 1; ; attempt++ {
+		conn, target, err := p.dialNextTarget(ctx)
+		retry := errors.Is(err, errProbeFailed) || (errors.Is(err, errImmediateClose) && p.config.immediateCloseRetry)
+		if !retry || attempt >= attempts {
+			dialed := attempt
+			if errors.Is(err, errNoTargets) || errors.Is(err, errNoHealthyTargets) || errors.Is(err, errTargetsDraining) {
+				// No target was dialed by the last attempt
+				dialed--
+			}
+			return conn, target, dialed, err
+		}
+
+		p.logger.warnf("retrying dial with the next target: %v", err)
+	}
+}
+
+// dialNextTarget dials an outbound connection to the next healthy target in the target set.
+// If no targets are healthy, the connection is either rejected or an unhealthy
+// target is tried depending on the configured behavior. Unhealthy targets are
+// never tried if a fallback target is configured, so that it is failed over to
+// without waiting for dials that are expected to fail.
+func (p *proxy) dialNextTarget(ctx context.Context) (net.Conn, string, error) {
+	target, healthy, err := p.targets.pick()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if !healthy {
+		noHealthyTargetsCounter.WithLabelValues(id, p.config.noHealthyTargets).Inc()
+		if p.config.noHealthyTargets == noHealthyTargetsReject || p.config.fallbackTarget != "" {
+			return nil, "", errNoHealthyTargets
+		}
+	}
+
+	conn, err := p.dial(ctx, target)
+	if err != nil {
+		countDialFailure(err)
+		p.markUnhealthy(target)
+		return nil, "", err
+	}
+
+	// Fail targets that accept the connection but close it immediately
+	if p.config.immediateCloseWindow > 0 {
+		closed, err := peekClosed(conn.(*net.TCPConn), p.config.immediateCloseWindow)
+		if err == nil && closed {
+			err = fmt.Errorf("%w: target=%s", errImmediateClose, target)
+			immediateCloseCounter.WithLabelValues(id).Inc()
+		}
+		if err != nil {
+			_ = conn.Close()
+			p.markUnhealthy(target)
+			return nil, "", err
+		}
+	}
+
+	// Fail targets that accept the connection but do not respond to the probe
+	if p.config.probe != "" {
+		err := p.probeTarget(conn, target)
+		if err != nil {
+			probeFailuresCounter.WithLabelValues(id).Inc()
+			_ = conn.Close()
+			p.markUnhealthy(target)
+			return nil, "", err
+		}
+	}
+
+	p.targets.markHealthy(target)
+	return conn, target, nil
+}
+
+// dial dials an outbound connection to the passed address, creating
+// its socket in the configured target network namespace. Targets that
+// override the dial timeout are dialed within their own timeout.
+func (p *proxy) dial(ctx context.Context, address string) (net.Conn, error) {
+	dialer := p.tcpDialer
+	if p.targets != nil {
+		if timeout, ok := p.targets.dialTimeout(address); ok {
+			d := *p.tcpDialer
+			d.Timeout = timeout
+			dialer = &d
+		}
+	}
+
+	if p.config.targetNetns == "" {
+		return dialer.DialContext(ctx, p.config.targetNetwork, address)
+	}
+
+	var conn net.Conn
+	err := inNetns(p.config.targetNetns, func() error {
+		var err error
+		conn, err = dialer.DialContext(ctx, p.config.targetNetwork, address)
+		return err
+	})
+	return conn, err
+}
+
+// dialBudget returns the maximum duration of dialing a connection, including retries with
+// other targets and failover. It leaves room for the longest dial timeout of the targets
+// followed by a dial of the fallback target, and is never less than the default bound.
+func (p *proxy) dialBudget() time.Duration {
+	longest := p.config.dialTimeout
+	if p.targets != nil {
+		if timeout := p.targets.maxDialTimeout(); timeout > longest {
+			longest = timeout
+		}
+	}
+
+	budget := longest + p.config.dialTimeout
+	if budget < outboundConnTimeout {
+		budget = outboundConnTimeout
+	}
+	return budget
+}
+
+// countDialFailure updates the metrics of dials that failed with the passed error.
+func countDialFailure(err error) {
+	dialFailuresCounter.WithLabelValues(id, dialFailureReason(err)).Inc()
+	if isDNSError(err) {
+		dnsResolutionFailuresCounter.WithLabelValues(id).Inc()
+	}
+}
+
+// markUnhealthy marks the passed target as unhealthy after a failed dial, draining
+// its connections if it just became unhealthy and unhealthy draining is enabled.
+func (p *proxy) markUnhealthy(target string) {
+	if p.targets.markUnhealthy(target) && p.config.unhealthyDrain > 0 {
+		p.drainUnhealthyTarget(target)
+	}
+}
+
 func (p *proxy) handleTCPConnection(inboundConn net.Conn, errorCh chan<- error) {
-	ctx, cancel := context.WithTimeout(context.Background(), outboundConnTimeout)
+	defer atomic.AddInt64(&p.handling, -1)
+
+	// Refuse new connections while draining
+	if p.isDraining() {
+		p.logger.debugf("refused connection: client=%v: proxy is draining", inboundConn.RemoteAddr().String())
+		err := p.rejectInbound(inboundConn, rejectReasonDraining)
+		if err != nil {
+			errorCh <- err
+		}
+		return
+	}
+
+	connsBySubnetCounter.WithLabelValues(id, p.subnets.label(inboundConn.RemoteAddr())).Inc()
+
+	// Act as the backend instead of forwarding in the echo and discard modes
+	if p.config.mode != modeProxy {
+		p.handleLocalConnection(inboundConn, errorCh)
+		return
+	}
+
+	// Reject inbound connections dialed by this proxy
+	if p.loops != nil {
+		if p.loops.addInbound(inboundConn.RemoteAddr()) {
+			loopDetectedCounter.WithLabelValues(id).Inc()
+			p.logger.errorf("rejected connection: client=%v: %v", inboundConn.RemoteAddr().String(), errLoopDetected)
+			err := p.rejectInbound(inboundConn, rejectReasonLoopDetected)
+			if err != nil {
+				errorCh <- err
+			}
+			return
+		}
+		defer p.loops.removeInbound(inboundConn.RemoteAddr())
+	}
+
+	// Optionally set the X-Forwarded-For header on plaintext HTTP traffic. The header is
+	// read before dialing so that clients sending oversized headers never tie up a target.
+	var inboundReader halfCloser = inboundConn.(*net.TCPConn)
+	if p.config.forwardedFor {
+		var err error
+		inboundReader, err = p.forwardedFor(inboundConn.(*net.TCPConn))
+		if err != nil {
+			reason := rejectReasonHeaderTooLarge
+			if errors.Is(err, errHeaderTimeout) {
+				reason = rejectReasonHeaderTimeout
+			} else {
+				headerLimitExceededCounter.WithLabelValues(id).Inc()
+			}
+			p.logger.errorf("rejected connection: client=%v: %v", inboundConn.RemoteAddr().String(), err)
+			err := p.rejectInbound(inboundConn, reason)
+			if err != nil {
+				errorCh <- err
+			}
+			return
+		}
+	}
+
+	// Optionally wait for the first byte from the client before dialing, so that
+	// clients that connect and never send bytes do not tie up a target
+	if p.config.lazyDial {
+		var err error
+		inboundReader, err = p.waitForFirstByte(inboundConn, inboundReader)
+		if err != nil {
+			p.logger.debugf("refused connection: client=%v: no bytes received: %v",
+				inboundConn.RemoteAddr().String(), err)
+			err := p.rejectInbound(inboundConn, rejectReasonNoData)
+			if err != nil {
+				errorCh <- err
+			}
+			return
+		}
+	}
+
+	// The dial timeout starts once the connection is ready to be dialed
+	ctx, cancel := context.WithTimeout(context.Background(), p.dialBudget())
 	defer cancel()
 
-	// Dial for an outbound connection
-	outboundConn, err := p.tcpDialer.DialContext(ctx, networkType, p.config.targetAddress)
+	// Dial for an outbound connection, failing it if it connects back to this proxy
+	activeDialingConnGauge.WithLabelValues(id).Inc()
+	var outboundConn net.Conn
+	var target string
+	var err error
+	if p.config.transparentDest {
+		outboundConn, target, err = p.dialOriginalDst(ctx, inboundConn)
+	} else if p.config.targetResolver != nil {
+		outboundConn, target, err = p.dialResolvedTarget(ctx, inboundConn.RemoteAddr())
+	} else {
+		outboundConn, target, err = p.dialTarget(ctx)
+	}
+	activeDialingConnGauge.WithLabelValues(id).Dec()
+	if err == nil && p.loops != nil && p.loops.addOutbound(outboundConn.LocalAddr()) {
+		loopDetectedCounter.WithLabelValues(id).Inc()
+		_ = outboundConn.Close()
+		err = errLoopDetected
+	}
+	p.dials.add(err == nil)
 	if err != nil {
 		// Could not establish outbound connection, so close inbound connection
-		err := inboundConn.Close()
-		if err != nil {
+		reason := rejectReasonDialFailed
+		if errors.Is(err, errLoopDetected) {
+			reason = rejectReasonLoopDetected
+		} else if errors.Is(err, errNoHealthyTargets) {
+			reason = rejectReasonNoHealthyTargets
+		} else if errors.Is(err, errTargetsDraining) {
+			reason = rejectReasonTargetsDraining
+		} else if errors.Is(err, errResolveFailed) {
+			reason = rejectReasonResolveFailed
+		} else if errors.Is(err, errNoOriginalDst) {
+			reason = rejectReasonNoOriginalDst
+		}
+		closeErr := p.rejectInbound(inboundConn, reason)
+		if closeErr != nil {
 			// Failure to close inbound connection and dial for outbound connection
 			// Communicate the error for a fatal exit of the program.
-			errorCh <- err
+			errorCh <- closeErr
 			return
 		}
 
-		// Inbound connection has been closed, so decrement active inbound gauge
-		atomic.AddInt64(&activeInboundConnCount, -1)
-		activeInboundConnGauge.WithLabelValues(id).Dec()
-
 		// Failing to dial does not kill the process, so just log the error and return
-		log.Println(err)
+		if reason == rejectReasonDialFailed {
+			p.logger.errorf("failed to dial target: reason=%s: %v", dialFailureReason(err), err)
+		} else {
+			p.logger.errorf("failed to dial target: %v", err)
+		}
+		return
+	}
+	if p.loops != nil {
+		defer p.loops.removeOutbound(outboundConn.LocalAddr())
+	}
+
+	// Send the configured preludes to the target and client before copying
+	err = p.writePreludes(inboundConn, outboundConn)
+	if err != nil {
+		_ = outboundConn.Close()
+		closeErr := p.rejectInbound(inboundConn, rejectReasonPreludeFailed)
+		if closeErr != nil {
+			errorCh <- closeErr
+			return
+		}
+
+		p.logger.errorf("failed to send prelude: client=%v: %v", inboundConn.RemoteAddr().String(), err)
 		return
 	}
 
 	// Outbound connection established, so increment active outbound gauge
-	outboundConnCounter.WithLabelValues(id).Inc()
-	atomic.AddInt64(&activeOutboundConnCount, 1)
+	targetLabel := target
+	if p.config.transparentDest {
+		targetLabel = originalDstTargetLabel
+	}
+	atomic.StoreInt64(&p.lastConn, time.Now().UnixNano())
+	outboundConnCounter.WithLabelValues(id, targetLabel).Inc()
+	active := atomic.AddInt64(&activeOutboundConnCount, 1)
 	activeOutboundConnGauge.WithLabelValues(id).Inc()
+	updateMax(&maxActiveOutboundConnCount, active, maxActiveOutboundConnGauge)
+	p.statsd.count("outbound_connection_count", 1)
+	p.statsd.gauge("active_outbound_connections", active)
 
-	// Channels to communicate amount of bytes copied
+	// Set the behavior of both sides of the connection on close
+	if p.config.linger >= 0 {
+		for _, conn := range []net.Conn{inboundConn, outboundConn} {
+			err := conn.(*net.TCPConn).SetLinger(p.config.linger)
+			if err != nil {
+				p.logger.warnf("error setting linger on connection: %v", err)
+			}
+		}
+	}
+
+	// Channels to communicate the results of copying
 	// between inbound and outbound connections
-	inboundBytesCh := make(chan int64, 1)
-	outboundBytesCh := make(chan int64, 1)
+	inboundCopyCh := make(chan copyResult, 1)
+	outboundCopyCh := make(chan copyResult, 1)
 
-	log.Printf("connection started: client=%v destination=%v",
-		inboundConn.RemoteAddr().String(),
-		outboundConn.RemoteAddr().String())
+	// Only log the start and end of sampled connections
+	sampled := p.sampleConnection()
+	if sampled {
+		p.logger.debugf("connection started: client=%v destination=%v",
+			inboundConn.RemoteAddr().String(),
+			outboundConn.RemoteAddr().String())
+	}
 	start := time.Now()
 
-	// Block until amount of bytes copied is communicated over each channel
-	go p.copy(outboundConn.(*net.TCPConn), inboundConn.(*net.TCPConn), inboundBytesCh)
-	go p.copy(inboundConn.(*net.TCPConn), outboundConn.(*net.TCPConn), outboundBytesCh)
-	inboundBytesCopied, outboundBytesCopied := <-inboundBytesCh, <-outboundBytesCh
+	// Close both sides of the connection if it outlives the maximum session duration
+	var deadlineExceeded int32
+	if p.config.maxSessionDuration > 0 {
+		timer := time.AfterFunc(p.config.maxSessionDuration, func() {
+			atomic.StoreInt32(&deadlineExceeded, 1)
+			_ = inboundConn.Close()
+			_ = outboundConn.Close()
+		})
+		defer timer.Stop()
+	}
+
+	// Close both sides of the connection if its target is removed or becomes unhealthy
+	// and the connection outlives the drain window
+	var drainReason atomic.Value
+	if p.conns != nil {
+		p.conns.add(target, outboundConn, func(reason string) {
+			drainReason.Store(reason)
+			_ = inboundConn.Close()
+			_ = outboundConn.Close()
+		})
+		defer p.conns.remove(target, outboundConn)
+	}
+
+	// Close both sides of the connection if the client sends bytes slower than the minimum rate
+	var slowClient int32
+	if p.config.minRate > 0 {
+		meter := &rateConn{halfCloser: inboundReader}
+		inboundReader = meter
+		stopCh := make(chan struct{})
+		defer close(stopCh)
+		go p.enforceMinRate(meter, func() {
+			atomic.StoreInt32(&slowClient, 1)
+			_ = inboundConn.Close()
+			_ = outboundConn.Close()
+		}, stopCh)
+	}
+
+	// Optionally inject faults, delaying reads in both directions and resetting both
+	// sides of connections selected to be dropped once their drop offset is proxied
+	var outboundReader halfCloser = outboundConn.(*net.TCPConn)
+	var faultDropped int32
+	if p.faults != nil {
+		var dropper *faultDropper
+		if offset, ok := p.faults.dropOffset(); ok {
+			var once sync.Once
+			dropper = &faultDropper{remaining: offset, drop: func() {
+				once.Do(func() {
+					faultsInjectedCounter.WithLabelValues(id, faultDrop).Inc()
+					atomic.StoreInt32(&faultDropped, 1)
+					for _, conn := range []net.Conn{inboundConn, outboundConn} {
+						_ = conn.(*net.TCPConn).SetLinger(0)
+						_ = conn.Close()
+					}
+				})
+			}}
+		}
+		inboundReader = &faultConn{halfCloser: inboundReader, ctx: p.ctx, delay: p.faults.delay, dropper: dropper}
+		outboundReader = &faultConn{halfCloser: outboundReader, ctx: p.ctx, delay: p.faults.delay, dropper: dropper}
+	}
+
+	// Optionally observe plaintext HTTP traffic to count and log requests
+	if p.config.httpMetrics || p.accessLog != nil {
+		client, _, _ := net.SplitHostPort(inboundConn.RemoteAddr().String())
+		observer := newHTTPObserver(client, p.config.httpMetrics, p.accessLog)
+		inboundReader, outboundReader = observer.observe(inboundReader, outboundReader)
+		defer observer.close()
+	}
+
+	// Track the last time bytes were read from either side, so that the connection
+	// can be closed if it is idle for longer than the drain idle timeout while draining
+	var drainIdle int32
+	if p.config.drainIdleTimeout > 0 {
+		activity := &connActivity{}
+		inboundReader = &activityConn{halfCloser: inboundReader, activity: activity}
+		outboundReader = &activityConn{halfCloser: outboundReader, activity: activity}
+		defer p.trackActivity(activity, func() {
+			atomic.StoreInt32(&drainIdle, 1)
+			_ = inboundConn.Close()
+			_ = outboundConn.Close()
+		})()
+	}
+
+	// Close both sides of the connection if a write to either side stalls for longer
+	// than the write timeout, since its peer has stopped reading
+	var inboundWriter, outboundWriter halfCloser = inboundConn.(*net.TCPConn), outboundConn.(*net.TCPConn)
+	var writeTimedOut int32
+	if p.config.writeTimeout > 0 {
+		var once sync.Once
+		closeWriteTimeout := func() {
+			once.Do(func() {
+				writeTimeoutsCounter.WithLabelValues(id).Inc()
+				atomic.StoreInt32(&writeTimedOut, 1)
+				_ = inboundConn.Close()
+				_ = outboundConn.Close()
+			})
+		}
+		inboundWriter = &writeTimeoutConn{TCPConn: inboundConn.(*net.TCPConn), ctx: p.ctx,
+			timeout: p.config.writeTimeout, onTimeout: closeWriteTimeout}
+		outboundWriter = &writeTimeoutConn{TCPConn: outboundConn.(*net.TCPConn), ctx: p.ctx,
+			timeout: p.config.writeTimeout, onTimeout: closeWriteTimeout}
+	}
+
+	// Interrupt copying promptly if the proxy is stopped forcefully
+	stopInterrupt := p.stopOnDone(p.ctx, inboundConn, outboundConn)
+	defer stopInterrupt()
+
+	// Block until the result of copying is communicated over each channel,
+	// determining the close reason from the side that ended first. With inline
+	// copying, bytes from the client are copied in this goroutine to save one
+	// goroutine per connection.
+	go p.copy(p.ctx, inboundWriter, outboundReader, BackendToClient, outboundCopyCh)
+	if p.config.inlineCopy {
+		p.copy(p.ctx, outboundWriter, inboundReader, ClientToBackend, inboundCopyCh)
+	} else {
+		go p.copy(p.ctx, outboundWriter, inboundReader, ClientToBackend, inboundCopyCh)
+	}
+	var inboundCopy, outboundCopy copyResult
+	var closeReason string
+	var halfOpenLimited int32
+	closeHalfOpen := func() {
+		atomic.StoreInt32(&halfOpenLimited, 1)
+		_ = inboundConn.Close()
+		_ = outboundConn.Close()
+	}
+	select {
+	case inboundCopy = <-inboundCopyCh:
+		closeReason = copyCloseReason(inboundCopy.err, clientSide, backendSide)
+		p.closeOnCopyError(inboundCopy, inboundConn, outboundConn)
+		outboundCopy = p.waitHalfOpen(outboundCopyCh, closeHalfOpen)
+	case outboundCopy = <-outboundCopyCh:
+		closeReason = copyCloseReason(outboundCopy.err, backendSide, clientSide)
+		p.closeOnCopyError(outboundCopy, inboundConn, outboundConn)
+		inboundCopy = p.waitHalfOpen(inboundCopyCh, closeHalfOpen)
+	}
+	inboundBytesCopied, outboundBytesCopied := inboundCopy.bytes, outboundCopy.bytes
+	partial := inboundCopy.partial || outboundCopy.partial
+
+	// Close both sides of the connection, which lingers if configured
+	_ = inboundConn.Close()
+	_ = outboundConn.Close()
+
+	// Connections closed by the proxy itself take the reason they were closed for
+	forced := true
+	if atomic.LoadInt32(&deadlineExceeded) == 1 {
+		closeReason = closeReasonSessionDeadline
+	} else if atomic.LoadInt32(&slowClient) == 1 {
+		closeReason = closeReasonSlowClient
+	} else if atomic.LoadInt32(&halfOpenLimited) == 1 {
+		closeReason = closeReasonHalfOpenLimit
+	} else if atomic.LoadInt32(&faultDropped) == 1 {
+		closeReason = closeReasonFaultDrop
+	} else if atomic.LoadInt32(&writeTimedOut) == 1 {
+		closeReason = closeReasonWriteTimeout
+	} else if atomic.LoadInt32(&drainIdle) == 1 {
+		closeReason = closeReasonDrainIdle
+	} else if reason, ok := drainReason.Load().(string); ok {
+		closeReason = reason
+	} else {
+		forced = false
+	}
 
 	elapsed := time.Now().Sub(start)
-	log.Printf("connection ended: client=%v destination=%v duration=%v bytes_copied=%d",
-		inboundConn.RemoteAddr().String(),
-		outboundConn.RemoteAddr().String(),
-		elapsed.String(),
-		inboundBytesCopied+outboundBytesCopied)
+	if sampled || partial || forced {
+		p.logger.infof("connection ended: client=%v destination=%v duration=%v bytes_copied=%d reason=%s partial=%t",
+			inboundConn.RemoteAddr().String(),
+			outboundConn.RemoteAddr().String(),
+			elapsed.String(),
+			inboundBytesCopied+outboundBytesCopied,
+			closeReason,
+			partial)
+	}
+
+	// Flag connections whose bytes in one direction dwarf the other
+	if p.config.asymmetryThreshold > 0 {
+		p.checkAsymmetry(inboundConn, outboundConn, inboundBytesCopied, outboundBytesCopied)
+	}
+
+	// Record the completed connection in the audit log
+	if p.audit != nil {
+		err := p.audit.write(auditRecord{
+			ID:              id,
+			Name:            p.config.name,
+			Start:           start,
+			End:             start.Add(elapsed),
+			Client:          inboundConn.RemoteAddr().String(),
+			Target:          target,
+			ClientToBackend: inboundBytesCopied,
+			BackendToClient: outboundBytesCopied,
+			CloseReason:     closeReason,
+		})
+		if err != nil {
+			p.logger.errorf("error writing audit log record: %v", err)
+		}
+	}
 
 	// Connection proxying complete, so update all metrics
+	connCloseReasonCounter.WithLabelValues(id, closeReason).Inc()
+	if inboundBytesCopied+outboundBytesCopied > 0 {
+		// Connections that copied no bytes were accepted and dialed but never served
+		connsCompletedCounter.WithLabelValues(id).Inc()
+	}
+	for _, result := range []copyResult{inboundCopy, outboundCopy} {
+		if result.partial {
+			partialCopyCounter.WithLabelValues(id).Inc()
+		}
+	}
 	inboundBytesCounter.WithLabelValues(id).Add(float64(inboundBytesCopied))
-	outboundBytesCounter.WithLabelValues(id).Add(float64(outboundBytesCopied))
-	atomic.AddInt64(&activeInboundConnCount, -1)
+	outboundBytesCounter.WithLabelValues(id, targetLabel).Add(float64(outboundBytesCopied))
+	if elapsed > 0 {
+		// Instantaneous connections have no meaningful throughput
+		throughput := float64(inboundBytesCopied+outboundBytesCopied) / elapsed.Seconds()
+		connThroughputHistogram.WithLabelValues(id).Observe(throughput)
+		copyThroughputGauge.WithLabelValues(id).Set(copyThroughput.add(throughput))
+	}
+	p.settleInbound(inboundConn, inboundBytesCopied+outboundBytesCopied > 0)
+	activeInbound := atomic.AddInt64(&activeInboundConnCount, -1)
 	activeInboundConnGauge.WithLabelValues(id).Dec()
-	atomic.AddInt64(&activeOutboundConnCount, -1)
+	activeOutbound := atomic.AddInt64(&activeOutboundConnCount, -1)
 	activeOutboundConnGauge.WithLabelValues(id).Dec()
+	p.statsd.count("inbound_bytes_count", inboundBytesCopied)
+	p.statsd.count("outbound_bytes_count", outboundBytesCopied)
+	p.statsd.gauge("active_inbound_connections", activeInbound)
+	p.statsd.gauge("active_outbound_connections", activeOutbound)
 }
 
-// copy copies bytes from the passed reader TCP connection to the passed writer
-// TCP connection until either EOF is reached on src or an error occurs.
-func (p *proxy) copy(writer *net.TCPConn, reader *net.TCPConn, byteCountCh chan<- int64) {
-	bytesCopied, err := io.Copy(writer, reader)
-	if err != nil {
-		log.Println(err)
+// closeOnCopyError closes both passed sides of a connection if the passed result of the
+// copy that ended first is an error and the proxy is configured to close both directions
+// on error, so that the copy in the other direction ends promptly rather than when its
+// own side ends. The close reason remains that of the error.
+func (p *proxy) closeOnCopyError(result copyResult, inboundConn, outboundConn net.Conn) {
+	if !p.config.closeBothOnError || result.err == nil {
+		return
+	}
+
+	_ = inboundConn.Close()
+	_ = outboundConn.Close()
+}
+
+// waitHalfOpen waits for the result of the copy that is still running after the copy
+// in the other direction ended, counting the connection as half-open meanwhile. If the
+// connection exceeds the configured maximum number of half-open connections, the
+// passed close function is called to close it.
+func (p *proxy) waitHalfOpen(resultCh <-chan copyResult, closeFn func()) copyResult {
+	// Both directions often end together, in which case the connection is not half-open
+	select {
+	case result := <-resultCh:
+		return result
+	default:
 	}
 
+	halfOpen := atomic.AddInt64(&activeHalfOpenConnCount, 1)
+	activeHalfOpenConnGauge.WithLabelValues(id).Inc()
+	defer func() {
+		atomic.AddInt64(&activeHalfOpenConnCount, -1)
+		activeHalfOpenConnGauge.WithLabelValues(id).Dec()
+	}()
+
+	if p.config.maxHalfOpen > 0 && halfOpen > int64(p.config.maxHalfOpen) {
+		closeFn()
+	}
+
+	return <-resultCh
+}
+
+// checkAsymmetry logs a warning and counts the connection if the bytes copied in one
+// direction exceed the configured asymmetry threshold times the bytes copied in the
+// other. A direction that copied no bytes is treated as having copied one byte.
+func (p *proxy) checkAsymmetry(inboundConn, outboundConn net.Conn, inboundBytes, outboundBytes int64) {
+	dominant := ClientToBackend
+	larger, smaller := inboundBytes, outboundBytes
+	if outboundBytes > inboundBytes {
+		dominant = BackendToClient
+		larger, smaller = outboundBytes, inboundBytes
+	}
+	if smaller < 1 {
+		smaller = 1
+	}
+
+	ratio := float64(larger) / float64(smaller)
+	if ratio <= p.config.asymmetryThreshold {
+		return
+	}
+
+	asymmetricConnCounter.WithLabelValues(id, dominant.String()).Inc()
+	p.logger.warnf("asymmetric connection: client=%v destination=%v direction=%s ratio=%.1f client_bytes=%d backend_bytes=%d",
+		inboundConn.RemoteAddr().String(),
+		outboundConn.RemoteAddr().String(),
+		dominant,
+		ratio,
+		inboundBytes,
+		outboundBytes)
+}
+
+// updateMax sets the passed maximum and its gauge to the passed value if it
+// exceeds the currently recorded maximum.
+func updateMax(max *int64, value int64, gauge *prometheus.GaugeVec) {
+	maxActiveConnMu.Lock()
+	defer maxActiveConnMu.Unlock()
+
+	if value > *max {
+		*max = value
+		gauge.WithLabelValues(id).Set(float64(value))
+	}
+}
+
+// sampleConnection returns true if the start and end of the next
+// connection should be logged according to the configured sample rate.
+func (p *proxy) sampleConnection() bool {
+	seq := atomic.AddUint64(&p.connSeq, 1)
+	return seq%uint64(p.config.logSampleRate) == 0
+}
+
+// copyResult is the result of copying bytes from one connection to another.
+type copyResult struct {
+	// bytes is the number of bytes copied.
+	bytes int64
+
+	// partial is true if copying ended on an error instead of EOF.
+	partial bool
+
+	// err is the error that copying ended on, or nil if it ended on EOF.
+	err error
+}
+
+// connSide is a side of a proxied connection, identified by its close reasons.
+type connSide struct {
+	eofReason   string
+	resetReason string
+}
+
+var (
+	clientSide  = connSide{eofReason: closeReasonClientEOF, resetReason: closeReasonClientReset}
+	backendSide = connSide{eofReason: closeReasonBackendEOF, resetReason: closeReasonBackendReset}
+)
+
+// copyCloseReason returns the close reason of a connection whose first copy to end,
+// from the passed reader side to the passed writer side, ended with the passed error.
+// Resets are attributed to the reader or writer side depending on whether they
+// were encountered reading or writing.
+func copyCloseReason(err error, reader, writer connSide) string {
+	if err == nil {
+		return reader.eofReason
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "write" {
+			return writer.resetReason
+		}
+		return reader.resetReason
+	}
+
+	return closeReasonError
+}
+
+// copy copies bytes from the passed reader connection to the passed writer
+// connection until either EOF is reached on src, an error occurs, or the passed
+// context is done. Bytes are copied through a stall buffer if one is configured,
+// read within the global rate limit if one is configured, and rewritten by the stream transformers for the passed direction if any are registered.
+func (p *proxy) copy(ctx context.Context, writer halfCloser, reader halfCloser, direction Direction, resultCh chan<- copyResult) {
+	var transformed io.Writer = writer
+	if len(p.config.transformers) > 0 {
+		transformed = &transformWriter{writer: writer, direction: direction, transformers: p.config.transformers}
+	}
+
+	var source io.Reader = reader
+	if p.globalRate != nil {
+		source = p.globalRateLimitedReader(ctx, reader)
+	}
+
+	var bytesCopied int64
+	var err error
+	if p.config.stallBufferSize > 0 {
+		bytesCopied, err = p.bufferedCopy(transformed, source)
+	} else {
+		bytesCopied, err = copyContext(ctx, transformed, source)
+	}
+	if err != nil && ctx.Err() != nil {
+		// Report the cancellation rather than the deadline error that interrupted copying
+		err = ctx.Err()
+	}
+	copyErr := err
+	partial := copyErr != nil
+	if partial {
+		p.logger.warnf("error copying bytes: %v", copyErr)
+	}
+
+	// Half-closing connections that are already torn down is expected to fail
 	err = writer.CloseWrite()
-	if err != nil {
-		log.Println(err)
+	if err != nil && !isExpectedCloseError(err) {
+		p.logger.warnf("error closing write side of connection: %v", err)
+		halfCloseErrorsCounter.WithLabelValues(id).Inc()
 	}
 
 	err = reader.CloseRead()
-	if err != nil {
-		log.Println(err)
+	if err != nil && !isExpectedCloseError(err) {
+		p.logger.warnf("error closing read side of connection: %v", err)
+		halfCloseErrorsCounter.WithLabelValues(id).Inc()
 	}
 
-	byteCountCh <- bytesCopied
+	resultCh <- copyResult{bytes: bytesCopied, partial: partial, err: copyErr}
 }
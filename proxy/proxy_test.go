@@ -0,0 +1,408 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const (
+	// drainTestConnCount is the number of long-lived connections open while the proxy drains.
+	drainTestConnCount = 3
+
+	// drainTestTransferSize is the number of bytes transferred by each connection while draining.
+	drainTestTransferSize = 1024 * 1024
+
+	// sessionTestDuration is the maximum session duration of connections in the session deadline test.
+	sessionTestDuration = 500 * time.Millisecond
+)
+
+func TestStopGracefulDrainsConnections(t *testing.T) {
+	// Connections handled locally have no outbound connection, so they are drained too
+	for _, mode := range []string{modeProxy, modeEcho} {
+		t.Run(mode, func(t *testing.T) {
+			testStopGracefulDrainsConnections(t, mode)
+		})
+	}
+}
+
+// testStopGracefulDrainsConnections tests that stopping a proxy having the passed
+// mode gracefully waits for its connections to end while refusing new ones.
+func testStopGracefulDrainsConnections(t *testing.T, mode string) {
+	target := startEchoServer(t)
+	defer target.Close()
+
+	doneCh := make(chan struct{})
+	listenAddress := freeAddress(t)
+	p := NewProxy(NewConfig(listenAddress, target.Addr().String(), "",
+		WithLogLevel("error"),
+		WithMode(mode),
+		WithDrainLogInterval(0)), doneCh)
+	go func() {
+		_ = p.Start()
+	}()
+
+	// Open long-lived connections through the proxy, making sure each is proxied
+	conns := make([]*net.TCPConn, drainTestConnCount)
+	for i := range conns {
+		conns[i] = dialProxy(t, listenAddress)
+		defer conns[i].Close()
+		echo(t, conns[i], []byte("ping"))
+	}
+
+	go p.StopGraceful()
+	waitFor(t, "proxy to start draining", p.isDraining)
+
+	// The proxy must not finish stopping while connections are open
+	select {
+	case <-doneCh:
+		t.Fatal("proxy stopped before its connections were drained")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// New connections must be closed without being proxied
+	refused := dialProxy(t, listenAddress)
+	defer refused.Close()
+	_, _ = refused.Write([]byte("ping"))
+	_ = refused.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := refused.Read(make([]byte, 4))
+	if err == nil || n != 0 {
+		t.Errorf("connection opened while draining was proxied, want it to be refused")
+	}
+
+	// Existing connections must finish their transfers cleanly
+	transfer := bytes.Repeat([]byte("0123456789abcdef"), drainTestTransferSize/16)
+	for _, conn := range conns {
+		echo(t, conn, transfer)
+		err := conn.CloseWrite()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.Read(make([]byte, 1))
+		if err != io.EOF {
+			t.Errorf("expected EOF after closing the connection, got: %v", err)
+		}
+	}
+
+	// The proxy must finish stopping once its connections are drained
+	select {
+	case <-doneCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy did not stop after its connections were drained")
+	}
+}
+
+func TestStopGracefulClosesSilentLazyDialClients(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  Option
+	}{
+		{name: "first-byte-timeout", opt: WithFirstByteTimeout(200 * time.Millisecond)},
+		{name: "drain-idle-timeout", opt: WithDrainIdleTimeout(200 * time.Millisecond)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := startEchoServer(t)
+			defer target.Close()
+
+			doneCh := make(chan struct{})
+			listenAddress := freeAddress(t)
+			p := NewProxy(NewConfig(listenAddress, target.Addr().String(), "",
+				WithLogLevel("error"),
+				WithLazyDial(true),
+				WithDrainLogInterval(0),
+				tt.opt), doneCh)
+			go func() {
+				_ = p.Start()
+			}()
+
+			// Connect without ever sending a byte, so the proxy waits for the first byte
+			conn := dialProxy(t, listenAddress)
+			defer conn.Close()
+			waitFor(t, "connection to be accepted", func() bool {
+				return atomic.LoadInt64(&activeInboundConnCount) == 1
+			})
+
+			go p.StopGraceful()
+			select {
+			case <-doneCh:
+			case <-time.After(5 * time.Second):
+				t.Fatal("proxy did not stop while a client that sent nothing was connected")
+			}
+		})
+	}
+}
+
+func TestCloseBothOnErrorEndsConnectionPromptly(t *testing.T) {
+	target, accepted := startHoldServer(t)
+	defer target.Close()
+
+	doneCh := make(chan struct{})
+	listenAddress := freeAddress(t)
+	p := NewProxy(NewConfig(listenAddress, target.Addr().String(), "",
+		WithLogLevel("error"),
+		WithCloseBothOnError(true)), doneCh)
+	go func() {
+		_ = p.Start()
+	}()
+	defer p.StopForceful()
+
+	// Open a connection through the proxy to a target that never sends or closes
+	conn := dialProxy(t, listenAddress)
+	defer conn.Close()
+	select {
+	case backend := <-accepted:
+		defer backend.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy did not connect to the target")
+	}
+	waitFor(t, "connection to be proxied", func() bool {
+		return atomic.LoadInt64(&activeOutboundConnCount) == 1
+	})
+
+	// Resetting the client fails the copy from the client, which must end the
+	// copy from the target too even though the target never ends its side
+	_ = conn.SetLinger(0)
+	_ = conn.Close()
+	waitFor(t, "connection to end", func() bool {
+		return atomic.LoadInt64(&activeOutboundConnCount) == 0
+	})
+}
+
+func TestMaxSessionDurationClosesConnection(t *testing.T) {
+	target := startEchoServer(t)
+	defer target.Close()
+
+	doneCh := make(chan struct{})
+	listenAddress := freeAddress(t)
+	p := NewProxy(NewConfig(listenAddress, target.Addr().String(), "",
+		WithLogLevel("error"),
+		WithMaxSessionDuration(sessionTestDuration)), doneCh)
+	go func() {
+		_ = p.Start()
+	}()
+	defer p.StopForceful()
+
+	closed := connCloseReasonCounter.WithLabelValues(id, closeReasonSessionDeadline)
+	before := testutil.ToFloat64(closed)
+
+	// Keep transferring bytes past the deadline, which must end the connection regardless
+	conn := dialProxy(t, listenAddress)
+	defer conn.Close()
+	start := time.Now()
+	_ = conn.SetDeadline(start.Add(5 * time.Second))
+	b := make([]byte, 4)
+	for {
+		_, err := conn.Write([]byte("ping"))
+		if err == nil {
+			_, err = io.ReadFull(conn, b)
+		}
+		if err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	elapsed := time.Since(start)
+	if elapsed < sessionTestDuration || elapsed > sessionTestDuration+time.Second {
+		t.Errorf("connection ended after %v, want it to end near %v", elapsed, sessionTestDuration)
+	}
+	waitFor(t, "connection to be closed for its session deadline", func() bool {
+		return testutil.ToFloat64(closed) == before+1
+	})
+}
+
+func TestStopForcefulWritesAuditRecords(t *testing.T) {
+	target, accepted := startHoldServer(t)
+	defer target.Close()
+
+	auditLog := filepath.Join(t.TempDir(), "audit.log")
+	doneCh := make(chan struct{})
+	listenAddress := freeAddress(t)
+	p := NewProxy(NewConfig(listenAddress, target.Addr().String(), "",
+		WithLogLevel("error"),
+		WithAuditLog(auditLog)), doneCh)
+	go func() {
+		_ = p.Start()
+	}()
+
+	// Open a connection through the proxy that is still copying when the proxy stops
+	conn := dialProxy(t, listenAddress)
+	defer conn.Close()
+	select {
+	case backend := <-accepted:
+		defer backend.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy did not connect to the target")
+	}
+	waitFor(t, "connection to be proxied", func() bool {
+		return atomic.LoadInt64(&activeOutboundConnCount) == 1
+	})
+
+	// The record of the interrupted connection must be written before the audit log is closed
+	p.StopForceful()
+	<-doneCh
+	b, err := ioutil.ReadFile(auditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := bytes.Count(b, []byte("\n")); records != 1 {
+		t.Errorf("audit log has %d records, want 1 for the interrupted connection", records)
+	}
+}
+
+// startEchoServer starts a TCP server that echoes the bytes it receives on each
+// connection until the connection is closed.
+func startEchoServer(t testing.TB) net.Listener {
+	listener, err := net.Listen(networkType, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener
+}
+
+// startHoldServer starts a TCP server that holds each connection open without
+// sending bytes or closing it, and sends the accepted connections on the returned channel.
+func startHoldServer(t testing.TB) (net.Listener, <-chan net.Conn) {
+	listener, err := net.Listen(networkType, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	return listener, accepted
+}
+
+// freeAddress returns a loopback address having a port that is free to listen on.
+func freeAddress(t testing.TB) string {
+	listener, err := net.Listen(networkType, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().String()
+}
+
+// dialProxy dials the proxy at the passed address, retrying until it is listening.
+func dialProxy(t testing.TB, address string) *net.TCPConn {
+	var conn net.Conn
+	var err error
+	for attempt := 0; attempt < 50; attempt++ {
+		conn, err = net.Dial(networkType, address)
+		if err == nil {
+			return conn.(*net.TCPConn)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	t.Fatalf("failed to dial proxy: %v", err)
+	return nil
+}
+
+// echo writes the passed bytes to the passed connection and
+// fails the test unless the same bytes are read back.
+func echo(t testing.TB, conn net.Conn, b []byte) {
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(b)
+		errCh <- err
+	}()
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := make([]byte, len(b))
+	_, err := io.ReadFull(conn, received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	err = <-errCh
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, b) {
+		t.Fatal("bytes read back differ from the bytes written")
+	}
+}
+
+// waitFor fails the test unless the passed condition becomes true within 5 seconds.
+func waitFor(t *testing.T, description string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func BenchmarkShortConnections(b *testing.B) {
+	b.Run("two-goroutines", func(b *testing.B) {
+		benchmarkShortConnections(b, WithInlineCopy(false))
+	})
+	b.Run("inline", func(b *testing.B) {
+		benchmarkShortConnections(b, WithInlineCopy(true))
+	})
+}
+
+// benchmarkShortConnections measures the rate at which a proxy having the passed
+// option proxies tiny, short-lived connections to an echo server, in parallel.
+func benchmarkShortConnections(b *testing.B, opt Option) {
+	target := startEchoServer(b)
+	defer target.Close()
+
+	doneCh := make(chan struct{})
+	listenAddress := freeAddress(b)
+	p := NewProxy(NewConfig(listenAddress, target.Addr().String(), "",
+		WithLogLevel("error"),
+		WithDrainLogInterval(0),
+		opt), doneCh)
+	go func() {
+		_ = p.Start()
+	}()
+	defer func() {
+		p.StopForceful()
+		<-doneCh
+	}()
+	dialProxy(b, listenAddress).Close()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			conn := dialProxy(b, listenAddress)
+			echo(b, conn, []byte("ping"))
+			_ = conn.Close()
+		}
+	})
+}
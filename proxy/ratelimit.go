@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// globalRateSlices is the number of slices each second of the global rate limit
+	// is divided into. Each read is limited to one slice of bytes, so that connections
+	// take turns drawing from the shared bucket rather than one large read starving
+	// the others.
+	globalRateSlices = 100
+
+	// globalRateInterval is the interval at which the aggregate throughput is measured.
+	globalRateInterval = time.Second
+)
+
+// tokenBucket is a token bucket rate limiter. Tokens are added at a fixed rate up
+// to a burst capacity, and each allowed event takes one. It is safe for concurrent use.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a new full token bucket that allows the passed rate
+// of events per second, with a burst capacity of one second of events.
+func newTokenBucket(rate float64) *tokenBucket {
+	burst := math.Max(rate, 1)
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// allow takes a token from the bucket and returns true if one is available.
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// reserve takes the passed number of tokens from the bucket, going into debt if too
+// few are available, and returns how long to wait before the tokens may be used.
+// Reservations are served in the order they are made, so waiters are not starved.
+func (b *tokenBucket) reserve(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// rateLimitedReader is a reader that draws a token from a shared bucket for
+// each byte read from it, waiting until the bucket allows the bytes.
+type rateLimitedReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	bucket  *tokenBucket
+	maxRead int
+	bytes   *int64
+}
+
+// Read reads at most one slice of the rate limit from the underlying reader, counts
+// the bytes read, and waits until the bucket allows them or the context is done.
+func (r *rateLimitedReader) Read(b []byte) (int, error) {
+	if len(b) > r.maxRead {
+		b = b[:r.maxRead]
+	}
+
+	n, err := r.reader.Read(b)
+	if n > 0 {
+		atomic.AddInt64(r.bytes, int64(n))
+		wait := r.bucket.reserve(float64(n))
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-r.ctx.Done():
+				timer.Stop()
+			}
+		}
+	}
+
+	return n, err
+}
+
+// globalRateLimitedReader returns a reader that reads from the passed reader
+// within the global rate limit shared by all connections.
+func (p *proxy) globalRateLimitedReader(ctx context.Context, reader io.Reader) io.Reader {
+	maxRead := p.config.globalRateLimit / globalRateSlices
+	if maxRead < 1 {
+		maxRead = 1
+	}
+
+	return &rateLimitedReader{
+		ctx:     ctx,
+		reader:  reader,
+		bucket:  p.globalRate,
+		maxRead: maxRead,
+		bytes:   &p.globalBytes,
+	}
+}
+
+// trackGlobalThroughput updates the aggregate throughput gauge of all connections
+// at a fixed interval until the proxy is stopped.
+func (p *proxy) trackGlobalThroughput() {
+	ticker := time.NewTicker(globalRateInterval)
+	defer ticker.Stop()
+
+	globalRateLimitGauge.WithLabelValues(id).Set(float64(p.config.globalRateLimit))
+	last := time.Now()
+	var lastBytes int64
+	for {
+		select {
+		case <-p.quitCh:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		bytes := atomic.LoadInt64(&p.globalBytes)
+		globalThroughputGauge.WithLabelValues(id).Set(float64(bytes-lastBytes) / now.Sub(last).Seconds())
+		last, lastBytes = now, bytes
+	}
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+const (
+	// maxRejectResponseBytes is the maximum size of the reject response, which is small
+	// enough to fit in the send buffer of a new socket so that writing it does not block.
+	maxRejectResponseBytes = 16 * 1024
+
+	// rejectResponseTimeout is the maximum duration of writing the reject response,
+	// bounding how long a client that does not read can hold up the accept loop.
+	rejectResponseTimeout = 100 * time.Millisecond
+)
+
+// setupRejectResponse reads the response written to rejected connections from the
+// configured file. Returns nil if no reject response file is configured.
+func (p *proxy) setupRejectResponse() ([]byte, error) {
+	if p.config.rejectResponseFile == "" {
+		return nil, nil
+	}
+
+	response, err := ioutil.ReadFile(p.config.rejectResponseFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read reject response: %w", err)
+	}
+	if len(response) > maxRejectResponseBytes {
+		return nil, fmt.Errorf("invalid reject response of %d bytes: must be at most %d bytes",
+			len(response), maxRejectResponseBytes)
+	}
+	return response, nil
+}
+
+// writeRejectResponse writes the reject response to the passed inbound connection
+// and closes its write side, so that the client reads the response before the
+// connection is closed. Errors are logged, since the connection is closed regardless.
+func (p *proxy) writeRejectResponse(inboundConn net.Conn) {
+	_ = inboundConn.SetWriteDeadline(time.Now().Add(rejectResponseTimeout))
+	_, err := inboundConn.Write(p.rejectResponse)
+	if err != nil {
+		p.logger.debugf("error writing reject response: client=%v: %v", inboundConn.RemoteAddr().String(), err)
+		return
+	}
+
+	if conn, ok := inboundConn.(halfCloser); ok {
+		_ = conn.CloseWrite()
+	}
+}
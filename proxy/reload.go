@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// targetConns tracks the active outbound connections to each target, so that
+// connections to targets removed on reload or that became unhealthy can be drained.
+// It is safe for concurrent use.
+type targetConns struct {
+	mu    sync.Mutex
+	conns map[string]map[net.Conn]func(reason string)
+}
+
+// newTargetConns returns a new targetConns.
+func newTargetConns() *targetConns {
+	return &targetConns{
+		conns: make(map[string]map[net.Conn]func(reason string)),
+	}
+}
+
+// add tracks the passed outbound connection to the passed target.
+// The passed close function closes the proxied connection with the passed
+// close reason when it is drained.
+func (t *targetConns) add(target string, conn net.Conn, closeFn func(reason string)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conns[target] == nil {
+		t.conns[target] = make(map[net.Conn]func(reason string))
+	}
+	t.conns[target][conn] = closeFn
+}
+
+// remove stops tracking the passed outbound connection to the passed target.
+func (t *targetConns) remove(target string, conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.conns[target], conn)
+	if len(t.conns[target]) == 0 {
+		delete(t.conns, target)
+	}
+}
+
+// closers returns the close functions of the active connections to the passed target.
+func (t *targetConns) closers(target string) []func(reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	closers := make([]func(reason string), 0, len(t.conns[target]))
+	for _, closeFn := range t.conns[target] {
+		closers = append(closers, closeFn)
+	}
+	return closers
+}
+
+// drainRemovedTargets gives the active connections to the passed removed targets
+// the configured reload drain window to finish, after which they are closed.
+// New connections are sent to the remaining targets in the meantime. Targets
+// that are added back before the window passes are not drained.
+func (p *proxy) drainRemovedTargets(removed []string) {
+	for _, target := range removed {
+		target := target
+		active := len(p.conns.closers(target))
+		if active == 0 {
+			continue
+		}
+
+		p.logger.infof("draining %d connections to removed target %s within %v",
+			active, target, p.config.reloadDrain)
+		time.AfterFunc(p.config.reloadDrain, func() {
+			for _, t := range p.targets.list() {
+				if t == target {
+					return
+				}
+			}
+
+			closers := p.conns.closers(target)
+			if len(closers) > 0 {
+				p.logger.infof("closing %d connections to removed target %s", len(closers), target)
+			}
+			for _, closeFn := range closers {
+				closeFn(closeReasonReloadDrain)
+			}
+		})
+	}
+}
+
+// drainUnhealthyTarget gives the active connections to the passed target, which
+// just became unhealthy, the configured unhealthy drain grace period to finish.
+// If the target is still unhealthy once the grace period passes, they are closed
+// so that their clients reconnect and are routed to the healthy targets.
+func (p *proxy) drainUnhealthyTarget(target string) {
+	active := len(p.conns.closers(target))
+	if active == 0 {
+		return
+	}
+
+	p.logger.infof("draining %d connections to unhealthy target %s within %v",
+		active, target, p.config.unhealthyDrain)
+	time.AfterFunc(p.config.unhealthyDrain, func() {
+		if p.targets.isHealthy(target) {
+			return
+		}
+
+		closers := p.conns.closers(target)
+		if len(closers) > 0 {
+			p.logger.infof("closing %d connections to unhealthy target %s", len(closers), target)
+		}
+		for _, closeFn := range closers {
+			unhealthyDrainCounter.WithLabelValues(id).Inc()
+			closeFn(closeReasonUnhealthyDrain)
+		}
+	})
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+const (
+	// rejectReasonResolveFailed is the reject reason of connections whose target
+	// could not be resolved by the target resolver.
+	rejectReasonResolveFailed = "resolve_failed"
+)
+
+var (
+	errResolveFailed = errors.New("unable to resolve the target")
+)
+
+// TargetResolver returns the address of the target that a connection from the passed
+// client address is proxied to, allowing custom routing such as consistent hashing to
+// be added to the proxy without forking it. It is called before each connection is
+// dialed, so it must be safe for concurrent use. The returned address labels the
+// outbound connection metrics, so it should come from a bounded set of targets.
+type TargetResolver func(clientAddr net.Addr) (string, error)
+
+// dialResolvedTarget dials an outbound connection to the target returned by the configured
+// target resolver for the passed client address, bypassing the target set and the fallback
+// target. Returns the connection and the address of its target.
+func (p *proxy) dialResolvedTarget(ctx context.Context, clientAddr net.Addr) (net.Conn, string, error) {
+	target, err := p.config.targetResolver(clientAddr)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: client=%v: %v", errResolveFailed, clientAddr, err)
+	}
+
+	conn, err := p.dialAddress(ctx, target)
+	if err != nil {
+		return nil, "", err
+	}
+	return conn, target, nil
+}
+
+// dialAddress dials an outbound connection to the passed target address, which is
+// not part of the target set, so that its health is not tracked.
+func (p *proxy) dialAddress(ctx context.Context, target string) (net.Conn, error) {
+	conn, err := p.dial(ctx, target)
+	if err != nil {
+		countDialFailure(err)
+		return nil, err
+	}
+
+	// Fail targets that accept the connection but do not respond to the probe
+	if p.config.probe != "" {
+		err = p.probeTarget(conn, target)
+		if err != nil {
+			probeFailuresCounter.WithLabelValues(id).Inc()
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"syscall"
+)
+
+// controlFunc is a function that sets options on a socket before it is connected or bound.
+type controlFunc func(network, address string, c syscall.RawConn) error
+
+// chainControls returns a control function that calls each of the passed
+// control functions in order, stopping at the first error.
+// Returns nil if no control functions are passed.
+func chainControls(controls ...controlFunc) controlFunc {
+	if len(controls) == 0 {
+		return nil
+	}
+
+	return func(network, address string, c syscall.RawConn) error {
+		for _, control := range controls {
+			err := control(network, address, c)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// setTTL returns an error, since setting the TTL of outbound sockets
+// is not supported on this platform.
+func setTTL(ttl int) (controlFunc, error) {
+	return nil, errors.New("setting the TTL of outbound connections is not supported on this platform")
+}
+
+// peekClosed returns false, since peeking at outbound sockets
+// is not supported on this platform.
+func peekClosed(conn *net.TCPConn, wait time.Duration) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,65 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package proxy
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// setTTL returns a dialer control function that sets the IP TTL (IPv4)
+// or unicast hop limit (IPv6) of outbound sockets to the passed value.
+func setTTL(ttl int) (controlFunc, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			if network == "tcp6" {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+			} else {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}, nil
+}
+
+// peekClosed waits up to the passed duration for the passed connection to be closed
+// by its peer, without consuming any bytes sent by the peer. Returns true if the peer
+// closed or reset the connection before sending any bytes.
+func peekClosed(conn *net.TCPConn, wait time.Duration) (bool, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return false, err
+	}
+
+	err = conn.SetReadDeadline(time.Now().Add(wait))
+	if err != nil {
+		return false, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	closed := false
+	buf := make([]byte, 1)
+	err = rc.Read(func(fd uintptr) bool {
+		n, _, err := syscall.Recvfrom(int(fd), buf, syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			// Nothing received yet, so wait for the socket to become readable
+			return false
+		}
+
+		// Reading zero bytes means EOF, while an error such as ECONNRESET means the
+		// connection was reset. Either way, the peer sent no bytes before closing.
+		closed = n == 0 || err != nil
+		return true
+	})
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return false, nil
+	}
+
+	return closed, err
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"net"
+	"strconv"
+)
+
+// statsdClient emits metrics to a StatsD agent over UDP.
+// All methods are no-ops on a nil client so that emitting metrics
+// has no overhead when StatsD is not configured.
+type statsdClient struct {
+	conn net.Conn
+}
+
+// newStatsdClient returns a new StatsD client that emits metrics to the passed address.
+func newStatsdClient(address string) (*statsdClient, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &statsdClient{
+		conn: conn,
+	}, nil
+}
+
+// count emits a counter metric incremented by the passed value.
+func (c *statsdClient) count(name string, value int64) {
+	if c == nil {
+		return
+	}
+
+	c.send(name, value, "c")
+}
+
+// gauge emits a gauge metric set to the passed value.
+func (c *statsdClient) gauge(name string, value int64) {
+	if c == nil {
+		return
+	}
+
+	c.send(name, value, "g")
+}
+
+// send writes a metric in the StatsD line format.
+// Errors are ignored since StatsD metrics are emitted on a best-effort basis.
+func (c *statsdClient) send(name string, value int64, metricType string) {
+	line := make([]byte, 0, len(name)+24)
+	line = append(line, name...)
+	line = append(line, ':')
+	line = strconv.AppendInt(line, value, 10)
+	line = append(line, '|')
+	line = append(line, metricType...)
+	_, _ = c.conn.Write(line)
+}
+
+// close closes the connection to the StatsD agent.
+func (c *statsdClient) close() error {
+	if c == nil {
+		return nil
+	}
+
+	return c.conn.Close()
+}
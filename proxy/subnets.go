@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+)
+
+const (
+	// otherSubnet is the subnet label of clients whose subnet could not be
+	// determined or exceeds the maximum number of tracked subnets.
+	otherSubnet = "other"
+)
+
+var (
+	ipv4SubnetMask = net.CIDRMask(24, 32)
+	ipv6SubnetMask = net.CIDRMask(64, 128)
+)
+
+// subnetLabels bounds the cardinality of subnet metric labels by tracking
+// up to a maximum number of distinct subnets. It is safe for concurrent use.
+type subnetLabels struct {
+	mu      sync.Mutex
+	max     int
+	subnets map[string]struct{}
+}
+
+// newSubnetLabels returns a new subnetLabels that tracks up to max distinct subnets.
+func newSubnetLabels(max int) *subnetLabels {
+	return &subnetLabels{
+		max:     max,
+		subnets: make(map[string]struct{}),
+	}
+}
+
+// label returns the subnet label for the passed client address. Clients are
+// grouped by /24 for IPv4 and /64 for IPv6. Once the maximum number of distinct
+// subnets has been reached, clients in new subnets are labeled as other.
+func (s *subnetLabels) label(addr net.Addr) string {
+	subnet := clientSubnet(addr)
+	if subnet == "" {
+		return otherSubnet
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.subnets[subnet]; ok {
+		return subnet
+	}
+	if len(s.subnets) >= s.max {
+		return otherSubnet
+	}
+
+	s.subnets[subnet] = struct{}{}
+	return subnet
+}
+
+// clientSubnet returns the /24 (IPv4) or /64 (IPv6) subnet of the passed address
+// in CIDR notation. Returns an empty string if the address is not a TCP address.
+func clientSubnet(addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+
+	if ip4 := tcpAddr.IP.To4(); ip4 != nil {
+		subnet := net.IPNet{IP: ip4.Mask(ipv4SubnetMask), Mask: ipv4SubnetMask}
+		return subnet.String()
+	}
+
+	subnet := net.IPNet{IP: tcpAddr.IP.Mask(ipv6SubnetMask), Mask: ipv6SubnetMask}
+	return subnet.String()
+}
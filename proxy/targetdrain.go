@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// handleDrainTarget starts or stops draining the target passed in the target query
+// parameter. POST starts draining it: no new connections are routed to it, and if a
+// grace query parameter is passed, its connections that outlive the grace period are
+// closed. DELETE stops draining it, so that new connections are routed to it again.
+func (p *proxy) handleDrainTarget(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodPost+", "+http.MethodDelete)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "missing target", http.StatusBadRequest)
+		return
+	}
+
+	var grace time.Duration
+	if value := r.URL.Query().Get("grace"); value != "" {
+		var err error
+		grace, err = time.ParseDuration(value)
+		if err != nil || grace < 0 {
+			http.Error(w, fmt.Sprintf("invalid grace %q: must be a non-negative duration", value), http.StatusBadRequest)
+			return
+		}
+	}
+
+	draining := r.Method == http.MethodPost
+	if !p.targets.setDraining(target, draining) {
+		http.Error(w, fmt.Sprintf("unknown target %q", target), http.StatusNotFound)
+		return
+	}
+
+	if !draining {
+		targetDrainingGauge.WithLabelValues(id, target).Set(0)
+		p.logger.infof("stopped draining target: target=%s", target)
+		_, _ = w.Write([]byte("not draining\n"))
+		return
+	}
+
+	targetDrainingGauge.WithLabelValues(id, target).Set(1)
+	p.logger.infof("draining target: target=%s grace=%v", target, grace)
+	if grace > 0 {
+		p.closeDrainedTarget(target, grace)
+	}
+	_, _ = w.Write([]byte("draining\n"))
+}
+
+// closeDrainedTarget closes the active connections to the passed draining target once
+// the passed grace period passes, unless the target has stopped draining by then.
+func (p *proxy) closeDrainedTarget(target string, grace time.Duration) {
+	time.AfterFunc(grace, func() {
+		if !p.targets.isDraining(target) {
+			return
+		}
+
+		closers := p.conns.closers(target)
+		if len(closers) > 0 {
+			p.logger.infof("closing %d connections to drained target %s", len(closers), target)
+		}
+		for _, closeFn := range closers {
+			closeFn(closeReasonTargetDrain)
+		}
+	})
+}
@@ -0,0 +1,435 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// targetsFilePollInterval is the interval at which the targets file is checked for changes.
+	targetsFilePollInterval = 5 * time.Second
+
+	// unhealthyTargetCooldown is how long a target is considered unhealthy after a failed dial.
+	unhealthyTargetCooldown = 10 * time.Second
+
+	// noHealthyTargetsReject rejects new connections when no targets are healthy.
+	noHealthyTargetsReject = "reject"
+
+	// noHealthyTargetsTryAll tries unhealthy targets when no targets are healthy.
+	noHealthyTargetsTryAll = "try-all"
+)
+
+const (
+	// targetOptionTimeout is the target option that overrides the dial timeout of a target.
+	targetOptionTimeout = "timeout"
+)
+
+var (
+	errNoTargets        = errors.New("no targets configured")
+	errNoHealthyTargets = errors.New("no healthy targets")
+	errTargetsDraining  = errors.New("all targets are draining")
+	errImmediateClose   = errors.New("target closed the connection immediately after accepting it")
+)
+
+// targetSet is the set of target addresses that connections are forwarded to.
+// Targets are considered unhealthy for a cooldown period after a failed dial.
+// Draining targets are not picked for new connections. Targets may override
+// the dial timeout of the proxy.
+// It is safe for concurrent use.
+type targetSet struct {
+	next      uint64
+	mu        sync.RWMutex
+	targets   []string
+	timeouts  map[string]time.Duration
+	unhealthy map[string]time.Time
+	draining  map[string]struct{}
+}
+
+// newTargetSet returns a new target set containing the passed target addresses
+// and their dial timeout overrides, which may be nil.
+func newTargetSet(targets []string, timeouts map[string]time.Duration) *targetSet {
+	return &targetSet{
+		targets:   targets,
+		timeouts:  timeouts,
+		unhealthy: make(map[string]time.Time),
+		draining:  make(map[string]struct{}),
+	}
+}
+
+// pick returns the next healthy target address that is not draining in round-robin
+// order. If no such target exists, the next target address that is not draining is
+// returned along with false. Draining targets are never returned: an error is
+// returned if every target is draining or if the target set is empty.
+func (s *targetSet) pick() (string, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.targets) == 0 {
+		return "", false, errNoTargets
+	}
+
+	now := time.Now()
+	n := atomic.AddUint64(&s.next, 1) - 1
+	for i := uint64(0); i < uint64(len(s.targets)); i++ {
+		target := s.targets[(n+i)%uint64(len(s.targets))]
+		if _, draining := s.draining[target]; !draining && s.healthyAt(target, now) {
+			return target, true, nil
+		}
+	}
+
+	for i := uint64(0); i < uint64(len(s.targets)); i++ {
+		target := s.targets[(n+i)%uint64(len(s.targets))]
+		if _, draining := s.draining[target]; !draining {
+			return target, false, nil
+		}
+	}
+
+	return "", false, errTargetsDraining
+}
+
+// healthyAt returns true if the passed target is healthy at the passed time.
+// The caller must hold the lock.
+func (s *targetSet) healthyAt(target string, now time.Time) bool {
+	until, ok := s.unhealthy[target]
+	return !ok || now.After(until)
+}
+
+// markHealthy marks the passed target as healthy.
+func (s *targetSet) markHealthy(target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.unhealthy, target)
+}
+
+// markUnhealthy marks the passed target as unhealthy for the cooldown period.
+// Returns true if the target was healthy before being marked.
+func (s *targetSet) markUnhealthy(target string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	wasHealthy := s.healthyAt(target, now)
+	s.unhealthy[target] = now.Add(unhealthyTargetCooldown)
+	return wasHealthy
+}
+
+// isHealthy returns true if the passed target is currently healthy.
+func (s *targetSet) isHealthy(target string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.healthyAt(target, time.Now())
+}
+
+// setDraining marks the passed target as draining or not. Returns false
+// if the target is not in the target set.
+func (s *targetSet) setDraining(target string, draining bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found := false
+	for _, t := range s.targets {
+		if t == target {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+
+	if draining {
+		s.draining[target] = struct{}{}
+	} else {
+		delete(s.draining, target)
+	}
+	return true
+}
+
+// dialTimeout returns the dial timeout override of the passed target.
+// Returns false if the target does not override the dial timeout.
+func (s *targetSet) dialTimeout(target string) (time.Duration, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	timeout, ok := s.timeouts[target]
+	return timeout, ok
+}
+
+// maxDialTimeout returns the longest dial timeout override of the targets,
+// or zero if no target overrides the dial timeout.
+func (s *targetSet) maxDialTimeout() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var longest time.Duration
+	for _, timeout := range s.timeouts {
+		if timeout > longest {
+			longest = timeout
+		}
+	}
+	return longest
+}
+
+// isDraining returns true if the passed target is draining.
+func (s *targetSet) isDraining(target string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, draining := s.draining[target]
+	return draining
+}
+
+// drainingTargets returns the target addresses in the target set that are draining.
+func (s *targetSet) drainingTargets() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	targets := make([]string, 0, len(s.draining))
+	for _, target := range s.targets {
+		if _, draining := s.draining[target]; draining {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// list returns a copy of the target addresses in the target set.
+func (s *targetSet) list() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	targets := make([]string, len(s.targets))
+	copy(targets, s.targets)
+	return targets
+}
+
+// health returns whether each target address in the target set is currently healthy.
+func (s *targetSet) health() map[string]bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	health := make(map[string]bool, len(s.targets))
+	for _, target := range s.targets {
+		health[target] = s.healthyAt(target, now)
+	}
+	return health
+}
+
+// counts returns the number of target addresses in the target set
+// and the number of them that are currently healthy.
+func (s *targetSet) counts() (total, healthy int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	for _, target := range s.targets {
+		if s.healthyAt(target, now) {
+			healthy++
+		}
+	}
+	return len(s.targets), healthy
+}
+
+// update atomically replaces the target addresses in the target set and their
+// dial timeout overrides. Returns the target addresses that were added and removed.
+func (s *targetSet) update(targets []string, timeouts map[string]time.Duration) (added, removed []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	added = difference(targets, s.targets)
+	removed = difference(s.targets, targets)
+	s.targets = targets
+	s.timeouts = timeouts
+	for _, target := range removed {
+		delete(s.unhealthy, target)
+		delete(s.draining, target)
+	}
+	return added, removed
+}
+
+// difference returns the strings in a that are not in b.
+func difference(a, b []string) []string {
+	seen := make(map[string]struct{}, len(b))
+	for _, s := range b {
+		seen[s] = struct{}{}
+	}
+
+	var diff []string
+	for _, s := range a {
+		if _, ok := seen[s]; !ok {
+			diff = append(diff, s)
+		}
+	}
+	return diff
+}
+
+// readTargetsFile reads target addresses from the file at the passed path.
+// The file contains one host:port address per line, optionally followed by
+// options separated by semicolons, e.g. host:port;timeout=2s to override the
+// dial timeout of the target. Blank lines and lines beginning with # are ignored.
+// Returns the target addresses and their dial timeout overrides. Returns an
+// error if any address or option is invalid or if the file lists no targets.
+func readTargetsFile(path string) ([]string, map[string]time.Duration, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var targets []string
+	timeouts := make(map[string]time.Duration)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Split(text, ";")
+		target := strings.TrimSpace(fields[0])
+		_, port, err := net.SplitHostPort(target)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if port == "" {
+			return nil, nil, fmt.Errorf("%s:%d: missing port in address %s", path, line, target)
+		}
+
+		for _, option := range fields[1:] {
+			key, value := option, ""
+			if i := strings.Index(option, "="); i >= 0 {
+				key, value = option[:i], option[i+1:]
+			}
+			key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+			if key != targetOptionTimeout {
+				return nil, nil, fmt.Errorf("%s:%d: unknown target option %q", path, line, key)
+			}
+
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout <= 0 {
+				return nil, nil, fmt.Errorf("%s:%d: invalid dial timeout %q: must be a positive duration", path, line, value)
+			}
+			timeouts[target] = timeout
+		}
+
+		targets = append(targets, target)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(targets) == 0 {
+		return nil, nil, fmt.Errorf("%s: no targets listed", path)
+	}
+
+	return targets, timeouts, nil
+}
+
+// setupTargets sets up the set of targets that connections are forwarded to.
+// The targets are read from the targets file if one is configured.
+func (p *proxy) setupTargets() (*targetSet, error) {
+	if p.config.targetsFile == "" {
+		return newTargetSet([]string{p.config.targetAddress}, nil), nil
+	}
+
+	targets, timeouts, err := readTargetsFile(p.config.targetsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	p.logger.infof("loaded %d targets from %s", len(targets), p.config.targetsFile)
+	return newTargetSet(targets, timeouts), nil
+}
+
+// targetCollectors returns prometheus collectors of the number of configured and
+// healthy targets. Since targets become healthy again once their cooldown passes,
+// the counts are computed from the target set each time the metrics are collected.
+func (p *proxy) targetCollectors() []prometheus.Collector {
+	count := func(healthy bool) func() float64 {
+		return func() float64 {
+			if p.targets == nil {
+				return 0
+			}
+			total, healthyTotal := p.targets.counts()
+			if healthy {
+				return float64(healthyTotal)
+			}
+			return float64(total)
+		}
+	}
+
+	return []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "targets_total",
+			Help:        "The number of targets currently configured",
+			ConstLabels: prometheus.Labels{"id": id},
+		}, count(false)),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "targets_healthy",
+			Help:        "The number of targets currently healthy",
+			ConstLabels: prometheus.Labels{"id": id},
+		}, count(true)),
+	}
+}
+
+// watchTargetsFile polls the targets file for changes until the proxy is stopped.
+// When the file changes, its targets are validated and then atomically swapped
+// into the target set. Invalid files are logged and leave the target set unchanged.
+func (p *proxy) watchTargetsFile() {
+	path := p.config.targetsFile
+	lastInfo, err := os.Stat(path)
+	if err != nil {
+		p.logger.errorf("error reading targets file: %v", err)
+	}
+
+	ticker := time.NewTicker(targetsFilePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.quitCh:
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			p.logger.errorf("error reading targets file: %v", err)
+			continue
+		}
+		if lastInfo != nil && info.ModTime().Equal(lastInfo.ModTime()) && info.Size() == lastInfo.Size() {
+			continue
+		}
+		lastInfo = info
+
+		targets, timeouts, err := readTargetsFile(path)
+		if err != nil {
+			p.logger.errorf("error reloading targets file, keeping current targets: %v", err)
+			continue
+		}
+
+		added, removed := p.targets.update(targets, timeouts)
+		for _, target := range added {
+			p.logger.infof("target added: %s", target)
+		}
+		for _, target := range removed {
+			p.logger.infof("target removed: %s", target)
+			targetDrainingGauge.DeleteLabelValues(id, target)
+		}
+		if p.conns != nil {
+			p.drainRemovedTargets(removed)
+		}
+	}
+}
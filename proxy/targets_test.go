@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadTargetsFile(t *testing.T) {
+	tests := []struct {
+		name         string
+		contents     string
+		wantTargets  []string
+		wantTimeouts map[string]time.Duration
+		wantErr      string
+	}{
+		{
+			name:         "targets",
+			contents:     "10.0.0.1:8080\n10.0.0.2:8080\n",
+			wantTargets:  []string{"10.0.0.1:8080", "10.0.0.2:8080"},
+			wantTimeouts: map[string]time.Duration{},
+		},
+		{
+			name:         "blank and comment lines",
+			contents:     "# targets\n\n  10.0.0.1:8080  \n\t\n  # disabled: 10.0.0.2:8080\n10.0.0.3:8080",
+			wantTargets:  []string{"10.0.0.1:8080", "10.0.0.3:8080"},
+			wantTimeouts: map[string]time.Duration{},
+		},
+		{
+			name:         "timeout option",
+			contents:     "10.0.0.1:8080;timeout=500ms\n10.0.0.2:8080 ; timeout = 5s\n10.0.0.3:8080\n",
+			wantTargets:  []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080"},
+			wantTimeouts: map[string]time.Duration{"10.0.0.1:8080": 500 * time.Millisecond, "10.0.0.2:8080": 5 * time.Second},
+		},
+		{
+			name:     "malformed timeout",
+			contents: "10.0.0.1:8080;timeout=soon\n",
+			wantErr:  `:1: invalid dial timeout "soon": must be a positive duration`,
+		},
+		{
+			name:     "missing timeout value",
+			contents: "10.0.0.1:8080\n10.0.0.2:8080;timeout\n",
+			wantErr:  `:2: invalid dial timeout "": must be a positive duration`,
+		},
+		{
+			name:     "negative timeout",
+			contents: "10.0.0.1:8080;timeout=-1s\n",
+			wantErr:  `:1: invalid dial timeout "-1s": must be a positive duration`,
+		},
+		{
+			name:     "unknown option",
+			contents: "10.0.0.1:8080;weight=2\n",
+			wantErr:  `:1: unknown target option "weight"`,
+		},
+		{
+			name:     "missing port",
+			contents: "10.0.0.1:\n",
+			wantErr:  ":1: missing port in address 10.0.0.1:",
+		},
+		{
+			name:     "empty file",
+			contents: "",
+			wantErr:  ": no targets listed",
+		},
+		{
+			name:     "only comments",
+			contents: "# no targets\n\n",
+			wantErr:  ": no targets listed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "targets")
+			err := ioutil.WriteFile(path, []byte(tt.contents), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			targets, timeouts, err := readTargetsFile(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasSuffix(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want it to end with %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(targets, tt.wantTargets) {
+				t.Errorf("got targets %v, want %v", targets, tt.wantTargets)
+			}
+			if !reflect.DeepEqual(timeouts, tt.wantTimeouts) {
+				t.Errorf("got timeouts %v, want %v", timeouts, tt.wantTimeouts)
+			}
+		})
+	}
+}
+
+func TestTargetSetPick(t *testing.T) {
+	targets := []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080"}
+	tests := []struct {
+		name        string
+		unhealthy   []string
+		draining    []string
+		wantPicked  []string
+		wantHealthy bool
+		wantErr     error
+	}{
+		{
+			name:        "round robin",
+			wantPicked:  []string{"10.0.0.1:8080", "10.0.0.2:8080", "10.0.0.3:8080", "10.0.0.1:8080"},
+			wantHealthy: true,
+		},
+		{
+			name:        "skips unhealthy",
+			unhealthy:   []string{"10.0.0.2:8080"},
+			wantPicked:  []string{"10.0.0.1:8080", "10.0.0.3:8080", "10.0.0.3:8080", "10.0.0.1:8080"},
+			wantHealthy: true,
+		},
+		{
+			name:        "skips draining",
+			draining:    []string{"10.0.0.1:8080", "10.0.0.3:8080"},
+			wantPicked:  []string{"10.0.0.2:8080", "10.0.0.2:8080", "10.0.0.2:8080"},
+			wantHealthy: true,
+		},
+		{
+			name:        "all unhealthy",
+			unhealthy:   targets,
+			wantPicked:  []string{"10.0.0.1:8080", "10.0.0.2:8080"},
+			wantHealthy: false,
+		},
+		{
+			name:        "unhealthy rather than draining",
+			unhealthy:   []string{"10.0.0.1:8080"},
+			draining:    []string{"10.0.0.2:8080", "10.0.0.3:8080"},
+			wantPicked:  []string{"10.0.0.1:8080", "10.0.0.1:8080"},
+			wantHealthy: false,
+		},
+		{
+			name:     "all draining",
+			draining: targets,
+			wantErr:  errTargetsDraining,
+		},
+		{
+			name:      "all draining and unhealthy",
+			unhealthy: targets,
+			draining:  targets,
+			wantErr:   errTargetsDraining,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTargetSet(targets, nil)
+			for _, target := range tt.unhealthy {
+				s.markUnhealthy(target)
+			}
+			for _, target := range tt.draining {
+				s.setDraining(target, true)
+			}
+
+			if tt.wantErr != nil {
+				for i := 0; i < len(targets); i++ {
+					target, _, err := s.pick()
+					if err != tt.wantErr {
+						t.Fatalf("picked %q with error %v, want error %v", target, err, tt.wantErr)
+					}
+				}
+				return
+			}
+			for _, want := range tt.wantPicked {
+				target, healthy, err := s.pick()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if target != want || healthy != tt.wantHealthy {
+					t.Errorf("picked %q healthy=%t, want %q healthy=%t", target, healthy, want, tt.wantHealthy)
+				}
+			}
+		})
+	}
+}
+
+func TestTargetSetPickEmpty(t *testing.T) {
+	_, _, err := newTargetSet(nil, nil).pick()
+	if err != errNoTargets {
+		t.Errorf("got error %v, want %v", err, errNoTargets)
+	}
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// tarpitOrReject rejects an inbound connection that will not be proxied for the passed
+// reason. If a tarpit is configured and fewer than the maximum number of connections
+// are tarpitted, the connection is held open instead, reading and discarding its bytes
+// until the tarpit duration passes, so that a misbehaving client cannot retry quickly.
+// Tarpitted connections are counted as rejected like any other.
+func (p *proxy) tarpitOrReject(inboundConn net.Conn, reason string) error {
+	if p.config.tarpit == 0 {
+		return p.rejectInbound(inboundConn, reason)
+	}
+
+	active := atomic.AddInt64(&p.tarpitted, 1)
+	if active > int64(p.config.maxTarpit) {
+		atomic.AddInt64(&p.tarpitted, -1)
+		return p.rejectInbound(inboundConn, reason)
+	}
+
+	connsRejectedCounter.WithLabelValues(id, reason).Inc()
+	tarpitConnCounter.WithLabelValues(id).Inc()
+	activeTarpitGauge.WithLabelValues(id).Inc()
+	go p.tarpit(inboundConn)
+	return nil
+}
+
+// tarpit holds the passed inbound connection open for the configured tarpit duration,
+// reading and discarding its bytes, and then closes it. The connection is closed
+// sooner if the client closes it or the proxy is stopped forcefully.
+func (p *proxy) tarpit(inboundConn net.Conn) {
+	defer func() {
+		atomic.AddInt64(&p.tarpitted, -1)
+		activeTarpitGauge.WithLabelValues(id).Dec()
+	}()
+
+	_ = inboundConn.SetReadDeadline(time.Now().Add(p.config.tarpit))
+	stopInterrupt := interruptOnDone(p.ctx, inboundConn)
+	_, _ = io.Copy(ioutil.Discard, inboundConn)
+	stopInterrupt()
+
+	err := p.closeInbound(inboundConn)
+	if err != nil {
+		p.logger.warnf("error closing tarpitted connection: %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"syscall"
+)
+
+const (
+	// tcpFastOpenSupported is true if TCP Fast Open is supported on this platform.
+	tcpFastOpenSupported = true
+
+	// tcpFastOpen is the TCP_FASTOPEN socket option, available since Linux 3.7.
+	tcpFastOpen = 0x17
+
+	// tcpFastOpenConnect is the TCP_FASTOPEN_CONNECT socket option, available since Linux 4.11.
+	tcpFastOpenConnect = 0x1e
+
+	// tcpFastOpenQueueLength is the maximum number of pending TCP Fast Open requests of the listener.
+	tcpFastOpenQueueLength = 256
+)
+
+// tcpFastOpenListenControl enables TCP Fast Open on listening sockets. Errors are
+// ignored so that kernels without TCP Fast Open enabled fall back to a regular handshake.
+func tcpFastOpenListenControl(network, address string, c syscall.RawConn) error {
+	return c.Control(func(fd uintptr) {
+		_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpen, tcpFastOpenQueueLength)
+	})
+}
+
+// tcpFastOpenDialControl enables TCP Fast Open on outbound sockets. Errors are
+// ignored so that kernels without TCP Fast Open enabled fall back to a regular handshake.
+func tcpFastOpenDialControl(network, address string, c syscall.RawConn) error {
+	return c.Control(func(fd uintptr) {
+		_ = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+	})
+}
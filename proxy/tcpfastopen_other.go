@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+// tcpFastOpenSupported is true if TCP Fast Open is supported on this platform.
+const tcpFastOpenSupported = false
+
+// tcpFastOpenListenControl is not called, since TCP Fast Open is not supported on this platform.
+var tcpFastOpenListenControl controlFunc
+
+// tcpFastOpenDialControl is not called, since TCP Fast Open is not supported on this platform.
+var tcpFastOpenDialControl controlFunc
@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"sync"
+)
+
+const (
+	// throughputWeight is the weight given to the throughput of each ended connection
+	// in the moving average, so that roughly the last 1/throughputWeight connections
+	// dominate it.
+	throughputWeight = 0.1
+)
+
+// movingAverage is an exponentially weighted moving average that is safe for concurrent use.
+type movingAverage struct {
+	mu      sync.Mutex
+	value   float64
+	started bool
+}
+
+// add adds the passed value to the moving average and returns the new average.
+// The first value added becomes the average.
+func (a *movingAverage) add(value float64) float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.started {
+		a.value = value
+		a.started = true
+	} else {
+		a.value += throughputWeight * (value - a.value)
+	}
+
+	return a.value
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"io"
+)
+
+// Direction is the direction that bytes are copied in by the proxy.
+type Direction int
+
+const (
+	// ClientToBackend is the direction of bytes sent by the client to the target.
+	ClientToBackend Direction = iota
+
+	// BackendToClient is the direction of bytes sent by the target to the client.
+	BackendToClient
+)
+
+// String returns the name of the direction.
+func (d Direction) String() string {
+	if d == ClientToBackend {
+		return "client_to_backend"
+	}
+
+	return "backend_to_client"
+}
+
+// StreamTransformer rewrites the bytes copied by the proxy, e.g. to redact
+// data, translate a protocol, or inject faults in tests.
+//
+// Transform is called with each chunk of bytes as it is read, in the order they are
+// read. Chunks are split wherever the underlying reads return, so a transformer
+// must not assume that a chunk holds a whole message and must carry any partial
+// data it needs over to the next call itself. The returned bytes are written in
+// place of the chunk, and may be shorter, longer, or empty. Transform is called
+// concurrently for different connections and directions, and must not retain
+// the passed slice after returning.
+type StreamTransformer interface {
+	Transform(direction Direction, b []byte) []byte
+}
+
+// StreamTransformerFunc is an adapter allowing an ordinary function to be used as a StreamTransformer.
+type StreamTransformerFunc func(direction Direction, b []byte) []byte
+
+// Transform calls f(direction, b).
+func (f StreamTransformerFunc) Transform(direction Direction, b []byte) []byte {
+	return f(direction, b)
+}
+
+// transformWriter is a writer that applies stream transformers to the bytes
+// written to it before writing them to the underlying writer.
+type transformWriter struct {
+	writer       io.Writer
+	direction    Direction
+	transformers []StreamTransformer
+}
+
+// Write transforms the passed bytes with each transformer in order and writes
+// the result. Returns len(b) once all transformed bytes are written, so that
+// the bytes copied count the bytes read rather than the bytes written.
+func (w *transformWriter) Write(b []byte) (int, error) {
+	read := len(b)
+	for _, transformer := range w.transformers {
+		b = transformer.Transform(w.direction, b)
+	}
+	if len(b) == 0 {
+		return read, nil
+	}
+
+	n, err := w.writer.Write(b)
+	if err != nil {
+		return 0, err
+	}
+	if n != len(b) {
+		return 0, io.ErrShortWrite
+	}
+
+	return read, nil
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+const (
+	// rejectReasonNoOriginalDst is the reject reason of connections whose original
+	// destination could not be read in transparent destination mode.
+	rejectReasonNoOriginalDst = "no_original_dst"
+
+	// originalDstTargetLabel is the target label of outbound connections made to their
+	// original destination. Original destinations are unbounded, so they are not labeled.
+	originalDstTargetLabel = "original_dst"
+)
+
+var (
+	errNoOriginalDst = errors.New("unable to read the original destination")
+)
+
+// dialOriginalDst dials an outbound connection to the destination that the passed inbound
+// connection was sent to before it was redirected to the proxy, bypassing the target set
+// and the fallback target. Returns the connection and the address of its target.
+func (p *proxy) dialOriginalDst(ctx context.Context, inboundConn net.Conn) (net.Conn, string, error) {
+	target, err := originalDst(inboundConn.(*net.TCPConn))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: client=%v: %v", errNoOriginalDst, inboundConn.RemoteAddr(), err)
+	}
+
+	conn, err := p.dialAddress(ctx, target)
+	if err != nil {
+		return nil, "", err
+	}
+	return conn, target, nil
+}
@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"syscall"
+	"time"
+)
+
+const (
+	// userTimeoutSupported is true if TCP user timeouts are supported on this platform.
+	userTimeoutSupported = true
+
+	// tcpUserTimeout is the TCP_USER_TIMEOUT socket option, available since Linux 2.6.37.
+	tcpUserTimeout = 0x12
+)
+
+// userTimeoutControl returns a control function that sets the TCP user timeout of sockets,
+// the maximum duration that transmitted data may remain unacknowledged before the kernel
+// closes the connection. Sockets accepted by a listening socket inherit its user timeout.
+func userTimeoutControl(timeout time.Duration) controlFunc {
+	millis := int(timeout / time.Millisecond)
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeout, millis)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
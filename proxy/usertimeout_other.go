@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"time"
+)
+
+// userTimeoutSupported is true if TCP user timeouts are supported on this platform.
+const userTimeoutSupported = false
+
+// userTimeoutControl is not called, since TCP user timeouts are not supported on this platform.
+func userTimeoutControl(timeout time.Duration) controlFunc {
+	return nil
+}
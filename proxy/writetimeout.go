@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// writeTimeoutConn is a TCP connection whose writes each fail if they do not complete
+// within a timeout, and that calls a timeout function when one does, so that a peer
+// that stops reading cannot block copying to it indefinitely.
+type writeTimeoutConn struct {
+	*net.TCPConn
+	ctx       context.Context
+	timeout   time.Duration
+	onTimeout func()
+}
+
+// Write writes the passed bytes to the underlying connection within the timeout.
+func (c *writeTimeoutConn) Write(b []byte) (int, error) {
+	err := c.TCPConn.SetWriteDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		return 0, err
+	}
+
+	// Resetting the deadline must not undo an interruption by interruptOnDone
+	err = c.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := c.TCPConn.Write(b)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() && c.ctx.Err() == nil {
+		c.onTimeout()
+	}
+	return n, err
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"flag"
+	"github.com/austingebauer/go-tcp-metrics-proxy/proxy"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	listenAddress        string
+	targetAddress        string
+	metricAddress        string
+	logLevel             string
+	logSampleRate        int
+	forwardedFor         bool
+	targetsFile          string
+	dialTimeout          time.Duration
+	noHealthyTargets     string
+	maxSessionDuration   time.Duration
+	maxSubnetLabels      int
+	bindAddress          string
+	statsdAddress        string
+	labels               labelFlags
+	httpMetrics          bool
+	loopDetection        bool
+	stallBufferSize      int
+	dnsServer            string
+	metricsAuth          string
+	metricsBearerToken   string
+	metricsTLSCert       string
+	metricsTLSKey        string
+	drainLogInterval     time.Duration
+	drainIdleTimeout     time.Duration
+	maxHeaderBytes       int
+	minRate              int
+	minRateGrace         time.Duration
+	ttl                  int
+	immediateCloseWindow time.Duration
+	immediateCloseRetry  bool
+	reloadDrain          time.Duration
+	tcpFastOpen          bool
+	linger               int
+	acceptWorkers        int
+	fallbackTarget       string
+	pidFile              string
+	mode                 string
+	unhealthyDrain       time.Duration
+	maxAcceptRate        float64
+	tarpit               time.Duration
+	maxTarpit            int
+	lazyDial             bool
+	firstByteTimeout     time.Duration
+	listenNetns          string
+	targetNetns          string
+	accessLog            string
+	faultDropRate        float64
+	faultDelay           time.Duration
+	faultSeed            int64
+	globalRateLimit      int
+	announceFile         string
+	asymmetryThreshold   float64
+	probe                string
+	probeResponse        string
+	probeTimeout         time.Duration
+	metricsAllowExternal bool
+	name                 string
+	terminationGrace     time.Duration
+	inlineCopy           bool
+	maxHalfOpen          int
+	auditLog             string
+	establishedAfter     time.Duration
+	userTimeout          time.Duration
+	rejectResponseFile   string
+	backendPreludeFile   string
+	clientPreludeFile    string
+	targetIPFamily       string
+	transparentDest      bool
+	writeTimeout         time.Duration
+	logConfig            bool
+	closeBothOnError     bool
+	forcefulReset        bool
+	logRate              int
+)
+
+// labelFlags is a repeatable flag of key=value labels.
+type labelFlags []string
+
+// String returns the labels as a comma-separated string.
+func (l *labelFlags) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set appends a label to the labels.
+func (l *labelFlags) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// registerFlags registers the flags of the proxy configuration on the passed flag set.
+func registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&name, "name", filepath.Base(os.Args[0]),
+		"Human-readable name of the proxy that tags its logs and is added to all prometheus metrics as the name label")
+	fs.StringVar(&listenAddress, "listen", "127.0.0.1:3000",
+		"IP address and port number that the proxy will listen on")
+	fs.StringVar(&announceFile, "announce-file", "",
+		"File to write the address the proxy listens on to once listening, e.g. to find the port chosen for -listen with port 0")
+	fs.StringVar(&listenNetns, "listen-netns", "",
+		"Path of the network namespace to listen in, e.g. /var/run/netns/<name> (Linux only)")
+	fs.IntVar(&acceptWorkers, "accept-workers", 1,
+		"Number of goroutines that concurrently accept connections on the listener")
+	fs.Float64Var(&maxAcceptRate, "max-accept-rate", 0,
+		"Maximum rate of new connections accepted per second, closing connections in excess of it (0 for no maximum)")
+	fs.DurationVar(&tarpit, "tarpit", 0,
+		"Duration to hold connections rejected by the accept rate or a connection filter open, reading and discarding their bytes, before closing them (0 to close them immediately)")
+	fs.IntVar(&maxTarpit, "max-tarpit", 1000,
+		"Maximum number of rejected connections held open by -tarpit at once, closing connections rejected in excess of it immediately")
+	fs.Float64Var(&asymmetryThreshold, "asymmetry-threshold", 0,
+		"Ratio between the bytes copied in each direction above which a connection is logged and counted as asymmetric (0 to disable)")
+	fs.IntVar(&globalRateLimit, "global-rate-limit", 0,
+		"Maximum aggregate throughput in bytes per second of all connections, shared between them (0 for no maximum)")
+	fs.Float64Var(&faultDropRate, "fault-drop-rate", 0,
+		"Probability between 0 and 1 of dropping each connection mid-stream, for chaos testing")
+	fs.DurationVar(&faultDelay, "fault-delay", 0,
+		"Latency added to each read in both directions, for chaos testing (0 to disable)")
+	fs.Int64Var(&faultSeed, "fault-seed", 0,
+		"Seed of the random number generator selecting connections to drop (0 to seed from the current time)")
+	fs.StringVar(&rejectResponseFile, "reject-response-file", "",
+		"File holding a response, such as an HTTP 503 response, written as is to rejected connections before they are closed")
+	fs.StringVar(&backendPreludeFile, "backend-prelude-file", "",
+		"File holding a prelude, such as a protocol greeting, written as is to each target once dialed, before any bytes from the client")
+	fs.StringVar(&clientPreludeFile, "client-prelude-file", "",
+		"File holding a prelude, such as a server greeting, written as is to each client once its target is dialed, before any bytes from the target")
+	fs.StringVar(&mode, "mode", "proxy",
+		"Forward connections to the targets (proxy), or act as the backend by echoing (echo) or discarding (discard) their bytes")
+	fs.StringVar(&targetAddress, "target", "127.0.0.1:3001",
+		"IP address and port number that the proxy will forward to")
+	fs.StringVar(&targetsFile, "targets-file", "",
+		"File containing IP addresses and port numbers to forward to, one per line (overrides -target)")
+	fs.DurationVar(&dialTimeout, "dial-timeout", 10*time.Second,
+		"Maximum duration of dialing a target, which targets in -targets-file may override")
+	fs.StringVar(&fallbackTarget, "fallback-target", "",
+		"IP address and port number of a standby target that is dialed when the targets fail or are unhealthy")
+	fs.DurationVar(&reloadDrain, "reload-drain", 0,
+		"Window that connections to targets removed from the targets file are given to finish before being closed (0 to leave them open)")
+	fs.DurationVar(&unhealthyDrain, "unhealthy-drain", 0,
+		"Grace period after which connections to a target that became unhealthy are closed if it is still unhealthy (0 to leave them open)")
+	fs.StringVar(&targetNetns, "target-netns", "",
+		"Path of the network namespace to dial targets in, e.g. /var/run/netns/<name> (Linux only)")
+	fs.StringVar(&targetIPFamily, "target-ip-family", "ipv4",
+		"IP family that targets are dialed over when their names resolve to both IPv4 and IPv6 addresses: ipv4, ipv6, or auto to let the dialer choose")
+	fs.BoolVar(&transparentDest, "transparent-dest", false,
+		"Forward connections redirected to the proxy by iptables to their original destination instead of the targets (Linux only)")
+	fs.StringVar(&bindAddress, "bind-address", "",
+		"Local IP address that outbound connections are made from")
+	fs.IntVar(&ttl, "ttl", 0,
+		"IP TTL (IPv4) or hop limit (IPv6) of outbound packets (0 for the system default)")
+	fs.DurationVar(&immediateCloseWindow, "immediate-close-window", 0,
+		"Window after dialing in which a target closing the connection is considered broken (0 to disable)")
+	fs.BoolVar(&immediateCloseRetry, "immediate-close-retry", false,
+		"Retry the dial with the next target when a target closes the connection immediately")
+	fs.StringVar(&probe, "per-conn-probe", "",
+		"Probe sent to the target of each connection before it is proxied, failing targets that do not reply with -per-conn-probe-response (empty to disable)")
+	fs.StringVar(&probeResponse, "per-conn-probe-response", "",
+		"Response that targets must reply to -per-conn-probe with")
+	fs.DurationVar(&probeTimeout, "per-conn-probe-timeout", time.Second,
+		"Timeout for targets to reply to -per-conn-probe within")
+	fs.BoolVar(&lazyDial, "lazy-dial", false,
+		"Dial the target only once the client sends its first byte, for protocols where the client speaks first")
+	fs.DurationVar(&firstByteTimeout, "first-byte-timeout", 0,
+		"Maximum duration of waiting for the first byte from the client with -lazy-dial (0 to use -dial-timeout)")
+	fs.BoolVar(&tcpFastOpen, "tcp-fastopen", false,
+		"Enable TCP Fast Open on the listener and outbound connections (Linux only)")
+	fs.DurationVar(&userTimeout, "user-timeout", 0,
+		"Maximum duration that data sent on inbound and outbound connections may remain unacknowledged before the connection is closed, Linux only (0 for the system default)")
+	fs.IntVar(&linger, "linger", -1,
+		"Seconds that closing a proxied connection blocks flushing unsent bytes (0 to reset the connection, -1 for the system default)")
+	fs.StringVar(&dnsServer, "dns-server", "",
+		"IP address and port number of the DNS server that target names are resolved with")
+	fs.StringVar(&noHealthyTargets, "no-healthy-targets", "try-all",
+		"Behavior when no targets are healthy: reject or try-all")
+	fs.BoolVar(&loopDetection, "loop-detection", false,
+		"Close connections whose target connects back to the proxy itself, detected only for loops that stay on the same host")
+	fs.BoolVar(&inlineCopy, "inline-copy", false,
+		"Copy bytes from the client in the goroutine handling the connection, saving one goroutine per connection")
+	fs.IntVar(&stallBufferSize, "stall-buffer-size", 0,
+		"Size in bytes of the buffer per direction that absorbs short stalls writing to either side of a connection (0 to disable)")
+	fs.IntVar(&minRate, "min-rate", 0,
+		"Minimum rate in bytes per second that sending clients must sustain over 10 seconds (0 for no minimum)")
+	fs.DurationVar(&minRateGrace, "min-rate-grace", 10*time.Second,
+		"Duration after a connection starts before -min-rate is enforced")
+	fs.BoolVar(&forcefulReset, "forceful-reset", false,
+		"Reset connections with an RST rather than closing them with a FIN when the proxy is stopped forcefully")
+	fs.DurationVar(&terminationGrace, "termination-grace", 0,
+		"Termination grace period after SIGTERM, e.g. the terminationGracePeriodSeconds of a Kubernetes pod; draining is cut short just before it ends (0 to drain without a deadline)")
+	fs.DurationVar(&drainLogInterval, "drain-log-interval", 5*time.Second,
+		"Initial interval between logs of connections being drained on shutdown, doubling after each log (0 to disable)")
+	fs.DurationVar(&drainIdleTimeout, "drain-idle-timeout", 0,
+		"Duration after which connections that have not read bytes from either side are closed while draining on shutdown (0 to wait for them)")
+	fs.BoolVar(&closeBothOnError, "close-both-on-error", false,
+		"Close both directions of a proxied connection as soon as copying in either direction fails")
+	fs.DurationVar(&writeTimeout, "write-timeout", 0,
+		"Maximum duration of each write to either side of a proxied connection, closing connections whose peer stops reading (0 for no maximum)")
+	fs.IntVar(&maxHalfOpen, "max-half-open", 0,
+		"Maximum number of half-open connections, closing connections that become half-open in excess of it (0 for no maximum)")
+	fs.DurationVar(&maxSessionDuration, "max-session-duration", 0,
+		"Maximum total duration of a proxied connection regardless of activity (0 for no maximum)")
+	fs.IntVar(&maxSubnetLabels, "max-subnet-labels", 256,
+		"Maximum number of distinct client subnets labeled in the connections_by_subnet metric")
+	fs.StringVar(&metricAddress, "metrics", "127.0.0.1:3002",
+		"IP address and port number to expose prometheus metrics and admin endpoints on (empty to disable)")
+	fs.BoolVar(&metricsAllowExternal, "metrics-allow-external", false,
+		"Allow the metrics server to listen on an address reachable from other hosts without a warning")
+	fs.StringVar(&metricsAuth, "metrics-auth", "",
+		"Basic auth credentials in user:pass form required by the metrics server")
+	fs.StringVar(&metricsBearerToken, "metrics-bearer-token", "",
+		"Bearer token required by the metrics server")
+	fs.StringVar(&metricsTLSCert, "metrics-tls-cert", "",
+		"PEM encoded certificate file to serve the metrics server over HTTPS with")
+	fs.StringVar(&metricsTLSKey, "metrics-tls-key", "",
+		"PEM encoded private key file of the metrics TLS certificate")
+	fs.StringVar(&statsdAddress, "statsd-addr", "",
+		"IP address and port number of a StatsD agent to emit metrics to")
+	fs.Var(&labels, "label",
+		"Constant key=value label added to all prometheus metrics (repeatable)")
+	fs.BoolVar(&httpMetrics, "http-metrics", false,
+		"Count requests on plaintext HTTP connections by method and status")
+	fs.DurationVar(&establishedAfter, "established-after", 0,
+		"Duration inbound connections must live, unless they exchange bytes, before they are counted as established; shorter ones are counted as probes (0 to count every connection)")
+	fs.StringVar(&auditLog, "audit-log", "",
+		"File to append a JSON record of each completed connection to, one per line (empty to disable)")
+	fs.StringVar(&accessLog, "access-log", "",
+		"Write plaintext HTTP requests to stdout in common or combined log format (empty to disable)")
+	fs.StringVar(&logLevel, "log-level", "info",
+		"Minimum level of messages to log: debug, info, warn, or error")
+	fs.IntVar(&logRate, "log-rate", 0,
+		"Maximum number of lines logged per second, suppressing lines in excess of it and periodically logging their number (0 for no maximum)")
+	fs.BoolVar(&logConfig, "log-config", false,
+		"Log the effective configuration on startup on a single line, with secrets redacted")
+	fs.IntVar(&logSampleRate, "log-sample-rate", 1,
+		"Log the start and end of 1 in every N connections")
+	fs.BoolVar(&forwardedFor, "x-forwarded-for", false,
+		"Set the X-Forwarded-For header on the first request of plaintext HTTP connections")
+	fs.IntVar(&maxHeaderBytes, "max-header-bytes", 64*1024,
+		"Maximum number of bytes read while looking for the end of a peeked header before closing the connection")
+	fs.StringVar(&pidFile, "pid-file", "",
+		"File to write the PID of the proxy to on startup, removed on shutdown")
+}
+
+// configOptions returns the proxy configuration options set by the registered flags.
+func configOptions() []proxy.Option {
+	return []proxy.Option{
+		proxy.WithLogLevel(logLevel),
+		proxy.WithLogSampleRate(logSampleRate),
+		proxy.WithForwardedFor(forwardedFor),
+		proxy.WithMaxHeaderBytes(maxHeaderBytes),
+		proxy.WithTargetsFile(targetsFile),
+		proxy.WithDialTimeout(dialTimeout),
+		proxy.WithMode(mode),
+		proxy.WithFallbackTarget(fallbackTarget),
+		proxy.WithReloadDrain(reloadDrain),
+		proxy.WithUnhealthyDrain(unhealthyDrain),
+		proxy.WithNetns(listenNetns, targetNetns),
+		proxy.WithTargetIPFamily(targetIPFamily),
+		proxy.WithTransparentDest(transparentDest),
+		proxy.WithBindAddress(bindAddress),
+		proxy.WithTTL(ttl),
+		proxy.WithUserTimeout(userTimeout),
+		proxy.WithRejectResponseFile(rejectResponseFile),
+		proxy.WithPreludeFiles(backendPreludeFile, clientPreludeFile),
+		proxy.WithImmediateClose(immediateCloseWindow, immediateCloseRetry),
+		proxy.WithPerConnProbe(probe, probeResponse, probeTimeout),
+		proxy.WithAcceptWorkers(acceptWorkers),
+		proxy.WithMaxAcceptRate(maxAcceptRate),
+		proxy.WithTarpit(tarpit, maxTarpit),
+		proxy.WithFaults(faultDropRate, faultDelay, faultSeed),
+		proxy.WithGlobalRateLimit(globalRateLimit),
+		proxy.WithAnnounceFile(announceFile),
+		proxy.WithAsymmetryThreshold(asymmetryThreshold),
+		proxy.WithLazyDial(lazyDial),
+		proxy.WithFirstByteTimeout(firstByteTimeout),
+		proxy.WithTCPFastOpen(tcpFastOpen),
+		proxy.WithLinger(linger),
+		proxy.WithDNSServer(dnsServer),
+		proxy.WithName(name),
+		proxy.WithMetricsAllowExternal(metricsAllowExternal),
+		proxy.WithMetricsAuth(metricsAuth),
+		proxy.WithMetricsBearerToken(metricsBearerToken),
+		proxy.WithMetricsTLS(metricsTLSCert, metricsTLSKey),
+		proxy.WithStatsdAddress(statsdAddress),
+		proxy.WithLabels(labels),
+		proxy.WithHTTPMetrics(httpMetrics),
+		proxy.WithAccessLog(accessLog),
+		proxy.WithAuditLog(auditLog),
+		proxy.WithEstablishedAfter(establishedAfter),
+		proxy.WithNoHealthyTargets(noHealthyTargets),
+		proxy.WithLoopDetection(loopDetection),
+		proxy.WithMaxSessionDuration(maxSessionDuration),
+		proxy.WithMinRate(minRate, minRateGrace),
+		proxy.WithForcefulReset(forcefulReset),
+		proxy.WithTerminationGrace(terminationGrace),
+		proxy.WithDrainLogInterval(drainLogInterval),
+		proxy.WithDrainIdleTimeout(drainIdleTimeout),
+		proxy.WithInlineCopy(inlineCopy),
+		proxy.WithCloseBothOnError(closeBothOnError),
+		proxy.WithWriteTimeout(writeTimeout),
+		proxy.WithLogRate(logRate),
+		proxy.WithLogConfig(logConfig),
+		proxy.WithMaxHalfOpen(maxHalfOpen),
+		proxy.WithStallBufferSize(stallBufferSize),
+		proxy.WithMaxSubnetLabels(maxSubnetLabels),
+	}
+}
+
+// serve runs the proxy until it is stopped by a signal or an error.
+func serve(args []string) {
+	// Parse flags and assign to configuration
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	registerFlags(fs)
+	_ = fs.Parse(args)
+	config := proxy.NewConfig(listenAddress, targetAddress, metricAddress, configOptions()...)
+
+	// Set up channels and signal handling
+	errorCh := make(chan error)
+	doneCh := make(chan struct{})
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+	pauseCh := make(chan os.Signal, 1)
+	notifyPause(pauseCh)
+
+	// Configure and run the proxy
+	p := proxy.NewProxy(config, doneCh)
+	go func() {
+		errorCh <- p.Start()
+	}()
+
+	// Write the PID file once the proxy is starting
+	if pidFile != "" {
+		err := writePIDFile(pidFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var finalError error
+
+	// Block until an error or stop signal is received, toggling pause on each pause signal
+	for stopped := false; !stopped; {
+		select {
+		case sig := <-pauseCh:
+			log.Printf("received signal: %v\n", sig)
+			if p.IsPaused() {
+				p.Resume()
+			} else {
+				p.Pause()
+			}
+		case sig := <-signalCh:
+			log.Printf("received signal: %v\n", sig)
+
+			// Stop gracefully for SIGTERM and SIGINT
+			p.StopGraceful()
+			stopped = true
+		case err := <-errorCh:
+			finalError = err
+
+			// Stop forcefully for errors
+			p.StopForceful()
+			stopped = true
+		}
+	}
+
+	// Block until the done channel has been closed by the proxy
+	<-doneCh
+	if pidFile != "" {
+		removePIDFile(pidFile)
+	}
+
+	// If the proxy stopped due to an error, then log fatally
+	if finalError != nil {
+		log.Fatal(finalError)
+	}
+
+	// Otherwise, the proxy stopped due to a signal, so exit 0
+	log.Println("exit: 0")
+	os.Exit(0)
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"fmt"
+)
+
+// version is the version of the proxy, set at build time with
+// -ldflags "-X main.version=<version>".
+var version = "dev"
+
+// printVersion prints the version of the proxy.
+func printVersion(args []string) {
+	fmt.Println(version)
+}